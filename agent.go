@@ -1,14 +1,65 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// exit statuses
+const (
+	exitOK = iota
+	exitError
+	exitDataLost
 )
 
 func main() {
+	err := newRootCmd().Execute()
+	if _, ok := err.(*FlushError); ok {
+		log.Println("ERROR:", err)
+		os.Exit(exitDataLost)
+	} else if err != nil {
+		log.Println("ERROR:", err)
+		os.Exit(exitError)
+	}
+
+	os.Exit(exitOK)
+}
+
+// runAgent runs the collector until it's told to stop by a signal. SIGHUP
+// reloads the configuration instead.
+func runAgent(cmd *cobra.Command, args []string) error {
 	config, err := ReadConfig()
 	if err != nil {
-		log.Fatal("error verifying config:", err)
+		return errors.Wrap(err, "error verifying config")
 	}
 
-	log.Fatal(config.Loop())
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go config.handleSignals(signals, cancel)
+	config.watchConfig(ctx)
+
+	return config.Loop(ctx)
+}
+
+// handleSignals has the collector reload its configuration on SIGHUP, and
+// stops it with cancel on any other signal.
+func (c *Config) handleSignals(signals <-chan os.Signal, cancel context.CancelFunc) {
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			log.Println("received SIGHUP, reloading config")
+			c.requestReload()
+			continue
+		}
+
+		log.Println("received signal:", sig)
+		cancel()
+		return
+	}
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	c := &Config{reloads: make(chan struct{}, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		c.handleSignals(signals, cancel)
+		close(done)
+	}()
+
+	signals <- syscall.SIGHUP
+	select {
+	case <-c.reloads:
+	case <-time.After(time.Second * 5):
+		t.Fatal("SIGHUP didn't request a reload")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("SIGHUP stopped the collector")
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("signals still handled after SIGTERM")
+	}
+	if ctx.Err() == nil {
+		t.Fatal("SIGTERM didn't stop the collector")
+	}
+}
@@ -3,12 +3,18 @@ package apiclient
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/MindsightCo/collector/cache"
+	"github.com/MindsightCo/collector/telemetry"
 	"github.com/machinebox/graphql"
 	"github.com/pkg/errors"
 	prommodel "github.com/prometheus/common/model"
@@ -45,6 +51,19 @@ func (a *apiAddr) queryAddr() string {
 	return a.base.ResolveReference(a.query).String()
 }
 
+// subscriptionAddr is the query endpoint, over a websocket.
+func (a *apiAddr) subscriptionAddr() string {
+	addr := a.base.ResolveReference(a.query)
+	switch addr.Scheme {
+	case "https":
+		addr.Scheme = "wss"
+	default:
+		addr.Scheme = "ws"
+	}
+
+	return addr.String()
+}
+
 func (a *apiAddr) metricsAddr() string {
 	return a.base.ResolveReference(a.metrics).String()
 }
@@ -53,62 +72,391 @@ type TokenBuilder interface {
 	GetAccessToken() (string, error)
 }
 
+// TokenRefresher is implemented by a TokenBuilder that can discard its cached
+// token and obtain a new one. MetricsPusher uses it to recover from a token
+// that the API rejects before it has expired.
+type TokenRefresher interface {
+	RefreshAccessToken() (string, error)
+}
+
 type MetricsPusher struct {
-	url  string
-	auth TokenBuilder
+	url     string
+	auth    TokenBuilder
+	retry   RetryPolicy
+	encoder Encoder
+	headers map[string]string
+
+	// instanceID identifies this collector in batch headers, so the API can
+	// tell apart batches from different collectors with the same sequence.
+	instanceID string
+
+	// maxBytes and maxSamples bound each push request, zero meaning no
+	// limit. acked holds the chunks of the last partially pushed batch that
+	// the API already took, so retrying that batch doesn't send them again.
+	maxBytes   int
+	maxSamples int
+	mu         sync.Mutex
+	acked      map[uint64]bool
+
+	// compressor is nil when request bodies are sent uncompressed.
+	// uncompressed is set once the API has refused a compressed body.
+	compressor   *compressor
+	uncompressed int32
+}
+
+// PusherOption configures optional MetricsPusher behavior.
+type PusherOption func(*MetricsPusher) error
+
+// WithRetryPolicy replaces DefaultRetryPolicy for the pusher.
+func WithRetryPolicy(policy RetryPolicy) PusherOption {
+	return func(p *MetricsPusher) error {
+		p.retry = policy
+		return nil
+	}
+}
+
+// WithEncoder replaces the default JSONEncoder for the pusher.
+func WithEncoder(encoder Encoder) PusherOption {
+	return func(p *MetricsPusher) error {
+		p.encoder = encoder
+		return nil
+	}
+}
+
+// WithEndpoint pushes to url exactly as given, rather than to the Mindsight
+// API's metrics path under the server url passed to NewMetricsPusher. This is
+// how to push to other backends, such as a remote-write receiver.
+func WithEndpoint(url string) PusherOption {
+	return func(p *MetricsPusher) error {
+		p.url = url
+		return nil
+	}
+}
+
+// WithHeaders adds extra headers to every push request, e.g. credentials for
+// a webhook or remote-write receiver.
+func WithHeaders(headers map[string]string) PusherOption {
+	return func(p *MetricsPusher) error {
+		p.headers = headers
+		return nil
+	}
 }
 
-func NewMetricsPusher(url string, auth TokenBuilder) (*MetricsPusher, error) {
+// WithInstanceID sends id with every sequenced batch (see PushBatch).
+func WithInstanceID(id string) PusherOption {
+	return func(p *MetricsPusher) error {
+		p.instanceID = id
+		return nil
+	}
+}
+
+// WithBatchLimits splits each push into requests whose encoded body is at
+// most maxBytes long (before compression) and which hold at most maxSamples
+// samples. Zero disables a limit.
+func WithBatchLimits(maxBytes, maxSamples int) PusherOption {
+	return func(p *MetricsPusher) error {
+		if maxBytes < 0 || maxSamples < 0 {
+			return errors.New("batch limits can't be negative")
+		}
+
+		p.maxBytes = maxBytes
+		p.maxSamples = maxSamples
+		return nil
+	}
+}
+
+// WithCompression compresses request bodies with the given encoding
+// (EncodingNone, EncodingGzip or EncodingZstd) at the given level, where zero
+// selects the encoding's default level. If the API answers 415 Unsupported
+// Media Type, the pusher falls back to uncompressed bodies for good.
+func WithCompression(encoding string, level int) PusherOption {
+	return func(p *MetricsPusher) error {
+		c, err := newCompressor(encoding, level)
+		if err != nil {
+			return err
+		}
+
+		p.compressor = c
+		return nil
+	}
+}
+
+// NewMetricsPusher returns a pusher for the API server at url. A nil auth
+// sends requests without an Authorization header.
+func NewMetricsPusher(url string, auth TokenBuilder, opts ...PusherOption) (*MetricsPusher, error) {
 	addr, err := newAPIAddr(url)
 	if err != nil {
 		return nil, err
 	}
 
-	return &MetricsPusher{
-		url:  addr.metricsAddr(),
-		auth: auth,
-	}, nil
+	p := &MetricsPusher{
+		url:     addr.metricsAddr(),
+		auth:    auth,
+		retry:   DefaultRetryPolicy,
+		encoder: JSONEncoder{},
+	}
+
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
 }
 
+// Headers identifying a sequenced batch, letting the API drop batches (and
+// chunks of batches) it has already received.
+const (
+	InstanceIDHeader = "X-Mindsight-Instance-ID"
+	BatchSeqHeader   = "X-Mindsight-Batch-Seq"
+	BatchChunkHeader = "X-Mindsight-Batch-Chunk"
+)
+
+// Push sends metrics that aren't part of a sequenced batch, see PushBatch.
 func (p *MetricsPusher) Push(ctx context.Context, metrics map[int]prommodel.Vector) error {
+	return p.PushBatch(ctx, 0, metrics)
+}
+
+// PushBatch sends metrics to the API, retrying transient failures according to
+// the pusher's RetryPolicy, unless ctx asks for a SingleAttempt. No retry is
+// made past ctx's deadline, or one set with RetryUntil. Errors that retrying
+// can't fix are reported as permanent (see IsPermanent).
+//
+// With batch limits, metrics are pushed in chunks and pushing stops at the
+// first chunk that can't be delivered, returning a *PartialError. Pushing the
+// same metrics again then skips the chunks that were already delivered. A
+// chunk the API rejects permanently is dropped and the other chunks are still
+// pushed.
+//
+// A non-zero seq identifies the batch: it is sent along with the chunk number
+// and the instance ID, so a batch that is pushed again after a failure can be
+// deduplicated.
+func (p *MetricsPusher) PushBatch(ctx context.Context, seq uint64, metrics map[int]prommodel.Vector) error {
 	if len(metrics) == 0 {
 		return nil
 	}
 
-	token, err := p.auth.GetAccessToken()
+	payloads, err := p.encodeChunks(metrics)
 	if err != nil {
-		return errors.Wrap(err, "get access token:")
+		return permanent(errors.Wrap(err, "encode metrics"))
+	}
+	if len(payloads) == 1 {
+		return p.send(ctx, payloads[0], p.batchHeaders(seq, 0, 1))
 	}
 
-	payload, err := json.Marshal(metrics)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	acked := make(map[uint64]bool, len(payloads))
+	pushed := 0
+	var rejected error
+
+	for i, payload := range payloads {
+		key := chunkKey(payload)
+		if p.acked[key] {
+			acked[key] = true
+			pushed++
+			continue
+		}
+
+		err := p.send(ctx, payload, p.batchHeaders(seq, i, len(payloads)))
+		if err == nil {
+			acked[key] = true
+			pushed++
+			continue
+		}
+		if IsPermanent(err) {
+			log.Printf("WARNING (push): dropping chunk %d of %d: %v\n", i+1, len(payloads), err)
+			acked[key] = true
+			rejected = err
+			continue
+		}
+
+		p.acked = acked
+		return &PartialError{Pushed: pushed, Total: len(payloads), Err: err}
+	}
+
+	p.acked = nil
+	if rejected != nil {
+		return &PartialError{Pushed: pushed, Total: len(payloads), Err: rejected}
+	}
+
+	return nil
+}
+
+// batchHeaders returns the headers identifying chunk i of n of batch seq, or
+// nil for an unsequenced batch.
+func (p *MetricsPusher) batchHeaders(seq uint64, i, n int) map[string]string {
+	if seq == 0 {
+		return nil
+	}
+
+	headers := map[string]string{
+		BatchSeqHeader:   strconv.FormatUint(seq, 10),
+		BatchChunkHeader: fmt.Sprintf("%d/%d", i+1, n),
+	}
+	if p.instanceID != "" {
+		headers[InstanceIDHeader] = p.instanceID
+	}
+
+	return headers
+}
+
+// send pushes a single encoded request body, with any extra headers.
+func (p *MetricsPusher) send(ctx context.Context, payload []byte, headers map[string]string) error {
+	body, encoding, err := p.encode(payload)
 	if err != nil {
-		return errors.Wrap(err, "json marshal metrics")
+		return permanent(errors.Wrap(err, "compress metrics"))
 	}
 
+	refreshed := false
+	refresh := false
+	attempt := 1
+
+	for {
+		err := p.post(ctx, body, encoding, headers, refresh)
+		if err == nil {
+			return nil
+		}
+		refresh = false
+		if IsPermanent(err) {
+			return err
+		}
+
+		var retryAfter time.Duration
+		if statusErr, ok := err.(*StatusError); ok {
+			if statusErr.StatusCode == http.StatusUnsupportedMediaType && encoding != "" {
+				log.Printf("WARNING (push): API refused %s request body, disabling compression\n", encoding)
+				atomic.StoreInt32(&p.uncompressed, 1)
+				body, encoding = payload, ""
+				continue
+			}
+			if statusErr.StatusCode == http.StatusUnauthorized && !refreshed {
+				// the token may have been revoked early, get a new one and
+				// try again right away
+				refreshed = true
+				refresh = true
+				continue
+			}
+			if statusErr.Rejected() {
+				return permanent(err)
+			}
+			if !statusErr.Retryable() {
+				return err
+			}
+			retryAfter = statusErr.RetryAfter
+		} else if ctx.Err() != nil {
+			return err
+		}
+
+		if attempt >= p.retry.maxAttempts(ctx) {
+			return errors.Wrapf(err, "push failed after %d attempts", attempt)
+		}
+
+		wait := p.retry.wait(attempt, retryAfter)
+		if !canRetryAt(ctx, time.Now().Add(wait)) {
+			return errors.Wrapf(err, "push failed after %d attempts, out of time to retry", attempt)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return errors.Wrap(err, "waiting to retry push")
+		}
+
+		attempt++
+	}
+}
+
+// encode compresses payload if compression is enabled, returning the body to
+// send and its content encoding ("" when uncompressed).
+func (p *MetricsPusher) encode(payload []byte) ([]byte, string, error) {
+	if _, present := p.encoder.Headers()["Content-Encoding"]; present {
+		return payload, "", nil
+	}
+	if p.compressor == nil || atomic.LoadInt32(&p.uncompressed) == 1 {
+		return payload, "", nil
+	}
+
+	body, err := p.compressor.compress(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body, p.compressor.encoding, nil
+}
+
+// post makes a single push request. Any failure to reach the API or to get a
+// token is considered transient; failures reported by the API are returned as
+// a *StatusError.
+func (p *MetricsPusher) post(ctx context.Context, payload []byte, encoding string, headers map[string]string, refreshToken bool) error {
 	req, err := http.NewRequest("POST", p.url, bytes.NewBuffer(payload))
 	if err != nil {
-		return errors.Wrap(err, "create http request")
+		return permanent(errors.Wrap(err, "create http request"))
+	}
+
+	for name, value := range p.encoder.Headers() {
+		req.Header.Set(name, value)
+	}
+	for name, value := range p.headers {
+		req.Header.Set(name, value)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	if p.auth != nil {
+		token, err := p.token(refreshToken)
+		if err != nil {
+			return errors.Wrap(err, "get access token:")
+		}
+		req.Header.Set("Authorization", "bearer "+token)
+	}
+
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	if p.retry.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.retry.AttemptTimeout)
+		defer cancel()
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "bearer "+token)
 
 	req = req.WithContext(ctx)
+	start := time.Now()
 	resp, err := http.DefaultClient.Do(req)
+	telemetry.PushDuration.Observe(time.Since(start).Seconds())
+	telemetry.PushBytes.Add(float64(len(payload)))
 	if err != nil {
+		telemetry.PushRequests.WithLabelValues("error").Inc()
 		return errors.Wrap(err, "do http request")
 	}
 	defer resp.Body.Close()
+	telemetry.PushRequests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		body, _ := ioutil.ReadAll(resp.Body)
-		return errors.Errorf("response status: %s, body: %s", resp.Status, string(body))
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       string(body),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
 	return nil
 }
 
+func (p *MetricsPusher) token(refresh bool) (string, error) {
+	if refresher, ok := p.auth.(TokenRefresher); ok && refresh {
+		return refresher.RefreshAccessToken()
+	}
+
+	return p.auth.GetAccessToken()
+}
+
 type Queryer struct {
 	client *graphql.Client
+	addr   *apiAddr
 	auth   TokenBuilder
 }
 
@@ -117,6 +465,9 @@ const metricSourcesQuery = `{
 		id
 		sourceURL
 		query
+		interval
+		mode
+		step
 	}
 }`
 
@@ -130,6 +481,7 @@ func NewQueryer(url string, token TokenBuilder) (*Queryer, error) {
 
 	return &Queryer{
 		client: client,
+		addr:   serverURL,
 		auth:   token,
 	}, nil
 }
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/MindsightCo/collector/cache"
 	gomock "github.com/golang/mock/gomock"
@@ -131,12 +133,244 @@ func TestPushMetrics(t *testing.T) {
 	}
 }
 
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     time.Millisecond,
+	Multiplier:     2,
+}
+
+type refreshingToken struct {
+	refreshes int
+}
+
+func (r *refreshingToken) GetAccessToken() (string, error) {
+	return testToken, nil
+}
+
+func (r *refreshingToken) RefreshAccessToken() (string, error) {
+	r.refreshes++
+	return testToken + "-refreshed", nil
+}
+
+func TestPushRetries(t *testing.T) {
+	metrics := map[int]prommodel.Vector{
+		1: prommodel.Vector{
+			&prommodel.Sample{
+				Timestamp: epoch,
+				Value:     prommodel.SampleValue(13.3),
+				Metric: prommodel.Metric{
+					"__name__": "joeblow",
+				},
+			},
+		},
+	}
+
+	var cases = []struct {
+		name          string
+		statuses      []int
+		retryAfter    string
+		singleAttempt bool
+		retryUntil    time.Duration
+		nCalls        int
+		expectErr     bool
+		permanent     bool
+		nRefreshes    int
+		expectedToken string
+	}{
+		{
+			name:          "succeeds after transient failures",
+			statuses:      []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			nCalls:        3,
+			expectedToken: "bearer " + testToken,
+		},
+		{
+			name:          "caps the wait requested by the API",
+			statuses:      []int{http.StatusServiceUnavailable, http.StatusOK},
+			retryAfter:    "600",
+			nCalls:        2,
+			expectedToken: "bearer " + testToken,
+		},
+		{
+			name:          "gives up after max attempts",
+			statuses:      []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			nCalls:        3,
+			expectErr:     true,
+			expectedToken: "bearer " + testToken,
+		},
+		{
+			name:          "does not retry a single attempt",
+			statuses:      []int{http.StatusServiceUnavailable},
+			singleAttempt: true,
+			nCalls:        1,
+			expectErr:     true,
+			expectedToken: "bearer " + testToken,
+		},
+		{
+			name:          "does not retry past the retry deadline",
+			statuses:      []int{http.StatusServiceUnavailable, http.StatusOK},
+			retryUntil:    time.Nanosecond,
+			nCalls:        1,
+			expectErr:     true,
+			expectedToken: "bearer " + testToken,
+		},
+		{
+			name:          "does not retry a bad request",
+			statuses:      []int{http.StatusBadRequest},
+			nCalls:        1,
+			expectErr:     true,
+			permanent:     true,
+			expectedToken: "bearer " + testToken,
+		},
+		{
+			name:          "refreshes the token once when unauthorized",
+			statuses:      []int{http.StatusUnauthorized, http.StatusOK},
+			nCalls:        2,
+			nRefreshes:    1,
+			expectedToken: "bearer " + testToken + "-refreshed",
+		},
+		{
+			name:          "unauthorized after refreshing isn't retried nor permanent",
+			statuses:      []int{http.StatusUnauthorized, http.StatusUnauthorized},
+			nCalls:        2,
+			expectErr:     true,
+			nRefreshes:    1,
+			expectedToken: "bearer " + testToken + "-refreshed",
+		},
+		{
+			name:          "forbidden isn't retried nor permanent",
+			statuses:      []int{http.StatusForbidden},
+			nCalls:        1,
+			expectErr:     true,
+			expectedToken: "bearer " + testToken,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var lastToken string
+			call := 0
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				lastToken = r.Header.Get("Authorization")
+				status := tc.statuses[call]
+				call++
+
+				if status == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "0")
+				}
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				w.WriteHeader(status)
+			}
+
+			fixture, tearDown := setup(t, handler, tc.nCalls)
+			defer tearDown(t)
+
+			token := &refreshingToken{}
+			pusher, err := NewMetricsPusher(fixture.server.URL, token, WithRetryPolicy(testRetryPolicy))
+			if err != nil {
+				t.Fatal("new metrics pusher:", err)
+			}
+
+			ctx := fixture.ctx
+			if tc.singleAttempt {
+				ctx = SingleAttempt(ctx)
+			}
+			if tc.retryUntil > 0 {
+				ctx = RetryUntil(ctx, time.Now().Add(tc.retryUntil))
+			}
+
+			err = pusher.Push(ctx, metrics)
+			if tc.expectErr != (err != nil) {
+				t.Fatal("unexpected push result:", err)
+			}
+			if IsPermanent(err) != tc.permanent {
+				t.Fatalf("permanent error got: %t expected: %t (%v)", IsPermanent(err), tc.permanent, err)
+			}
+			if token.refreshes != tc.nRefreshes {
+				t.Fatalf("token refreshes got: %d expected: %d", token.refreshes, tc.nRefreshes)
+			}
+			if lastToken != tc.expectedToken {
+				t.Fatalf("auth header got: %s expected: %s", lastToken, tc.expectedToken)
+			}
+		})
+	}
+}
+
+func TestPushAttemptTimeout(t *testing.T) {
+	metrics := map[int]prommodel.Vector{
+		1: prommodel.Vector{&prommodel.Sample{Timestamp: epoch, Value: 1, Metric: prommodel.Metric{"__name__": "joeblow"}}},
+	}
+
+	// requests overlap here, since the first one hangs until the test is over
+	release := make(chan struct{})
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	policy := testRetryPolicy
+	policy.AttemptTimeout = 50 * time.Millisecond
+	pusher, err := NewMetricsPusher(server.URL, nil, WithRetryPolicy(policy))
+	if err != nil {
+		t.Fatal("new metrics pusher:", err)
+	}
+
+	if err := pusher.Push(context.Background(), metrics); err != nil {
+		t.Fatal("push after a hung attempt:", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatal("unexpected number of calls:", n)
+	}
+}
+
+func TestPushBadRequest(t *testing.T) {
+	metrics := map[int]prommodel.Vector{
+		1: prommodel.Vector{&prommodel.Sample{Timestamp: epoch, Value: 1, Metric: prommodel.Metric{"__name__": "joeblow"}}},
+	}
+
+	// no request can be made to this endpoint, there's nothing to retry
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Second}
+	pusher, err := NewMetricsPusher("http://localhost", nil, WithEndpoint("http://local host/"), WithRetryPolicy(policy))
+	if err != nil {
+		t.Fatal("new metrics pusher:", err)
+	}
+
+	start := time.Now()
+	err = pusher.Push(context.Background(), metrics)
+	if !IsPermanent(err) {
+		t.Fatal("expected a permanent error, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatal("request that can't be made was retried, took:", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := epoch.Time()
+
+	if d := parseRetryAfter("7", now); d != 7*time.Second {
+		t.Fatal("retry-after seconds:", d)
+	}
+	if d := parseRetryAfter(now.Add(time.Minute).UTC().Format(http.TimeFormat), now); d != time.Minute {
+		t.Fatal("retry-after date:", d)
+	}
+	if d := parseRetryAfter("soon", now); d != 0 {
+		t.Fatal("retry-after garbage:", d)
+	}
+}
+
 const sourcesJSON = `
 {
 	"data": {
 		"metricSources": [
 			{"id":77, "sourceURL": "http://source-1", "query":"query{num=\"1\"}"},
-			{"id":77, "sourceURL": "http://source-2", "query":"query{num=\"2\"}"}
+			{"id":77, "sourceURL": "http://source-2", "query":"query{num=\"2\"}", "interval": "1m"}
 		]
 	}
 }
@@ -153,6 +387,7 @@ func TestRefreshSources(t *testing.T) {
 			SourceID: 77,
 			URL:      "http://source-2",
 			Query:    "query{num=\"2\"}",
+			Interval: time.Minute,
 		},
 	}
 
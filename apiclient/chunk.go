@@ -0,0 +1,167 @@
+package apiclient
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	prommodel "github.com/prometheus/common/model"
+)
+
+// PartialError is returned by MetricsPusher.Push when only some of the chunks
+// of a batch were delivered.
+type PartialError struct {
+	Pushed, Total int
+	Err           error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("pushed %d of %d chunks: %v", e.Pushed, e.Total, e.Err)
+}
+
+func (e *PartialError) Cause() error {
+	return e.Err
+}
+
+// encodeChunks splits metrics according to the pusher's batch limits and
+// encodes each chunk.
+func (p *MetricsPusher) encodeChunks(metrics map[int]prommodel.Vector) ([][]byte, error) {
+	var payloads [][]byte
+	for _, chunk := range splitSamples(metrics, p.maxSamples) {
+		encoded, err := p.encodeBounded(chunk)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, encoded...)
+	}
+
+	return payloads, nil
+}
+
+// encodeBounded encodes metrics, halving them until every payload fits in
+// maxBytes. A single sample that's still too large is sent as is, it's up to
+// the API to take it or not.
+func (p *MetricsPusher) encodeBounded(metrics map[int]prommodel.Vector) ([][]byte, error) {
+	payload, err := p.encoder.Encode(metrics)
+	if err != nil {
+		return nil, err
+	}
+	if p.maxBytes == 0 || len(payload) <= p.maxBytes {
+		return [][]byte{payload}, nil
+	}
+
+	first, second := bisect(metrics)
+	if second == nil {
+		return [][]byte{payload}, nil
+	}
+
+	payloads, err := p.encodeBounded(first)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := p.encodeBounded(second)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(payloads, rest...), nil
+}
+
+func sortedIDs(metrics map[int]prommodel.Vector) []int {
+	ids := make([]int, 0, len(metrics))
+	for id := range metrics {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// splitSamples groups sources into chunks of at most max samples. A source is
+// only split across chunks when it has more than max samples by itself.
+func splitSamples(metrics map[int]prommodel.Vector, max int) []map[int]prommodel.Vector {
+	if max == 0 {
+		return []map[int]prommodel.Vector{metrics}
+	}
+
+	var chunks []map[int]prommodel.Vector
+	chunk := make(map[int]prommodel.Vector)
+	n := 0
+
+	for _, id := range sortedIDs(metrics) {
+		vector := metrics[id]
+		if n > 0 && n+len(vector) > max && len(vector) <= max {
+			chunks = append(chunks, chunk)
+			chunk, n = make(map[int]prommodel.Vector), 0
+		}
+
+		for len(vector) > 0 {
+			if n == max {
+				chunks = append(chunks, chunk)
+				chunk, n = make(map[int]prommodel.Vector), 0
+			}
+
+			take := max - n
+			if take > len(vector) {
+				take = len(vector)
+			}
+			chunk[id] = append(chunk[id], vector[:take]...)
+			vector = vector[take:]
+			n += take
+		}
+	}
+
+	if n > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// bisect splits metrics into two halves by sample count, on a source boundary
+// when there are several sources. second is nil if metrics hold a single
+// sample.
+func bisect(metrics map[int]prommodel.Vector) (first, second map[int]prommodel.Vector) {
+	ids := sortedIDs(metrics)
+	if len(ids) == 1 {
+		vector := metrics[ids[0]]
+		if len(vector) < 2 {
+			return metrics, nil
+		}
+
+		half := len(vector) / 2
+		return map[int]prommodel.Vector{ids[0]: vector[:half]},
+			map[int]prommodel.Vector{ids[0]: vector[half:]}
+	}
+
+	total := 0
+	for _, id := range ids {
+		total += len(metrics[id])
+	}
+
+	// move sources to the first half until it holds about half the samples,
+	// leaving at least one source for the second half
+	first = make(map[int]prommodel.Vector)
+	second = make(map[int]prommodel.Vector)
+	n := 0
+	split := false
+	for i, id := range ids {
+		split = split || (i > 0 && (i == len(ids)-1 || n+len(metrics[id])/2 >= total/2))
+		if split {
+			second[id] = metrics[id]
+			continue
+		}
+
+		first[id] = metrics[id]
+		n += len(metrics[id])
+	}
+
+	return first, second
+}
+
+// chunkKey identifies an encoded chunk, encoders being deterministic.
+func chunkKey(payload []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(payload)
+	return h.Sum64()
+}
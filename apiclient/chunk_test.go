@@ -0,0 +1,162 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	prommodel "github.com/prometheus/common/model"
+)
+
+func testSamples(n int, value float64) prommodel.Vector {
+	var vector prommodel.Vector
+	for i := 0; i < n; i++ {
+		vector = append(vector, &prommodel.Sample{
+			Timestamp: epoch,
+			Value:     prommodel.SampleValue(value),
+			Metric: prommodel.Metric{
+				"__name__": "joeblow",
+			},
+		})
+	}
+
+	return vector
+}
+
+func chunkSizes(chunks []map[int]prommodel.Vector) []map[int]int {
+	var sizes []map[int]int
+	for _, chunk := range chunks {
+		size := make(map[int]int)
+		for id, vector := range chunk {
+			size[id] = len(vector)
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes
+}
+
+func TestSplitSamples(t *testing.T) {
+	metrics := map[int]prommodel.Vector{
+		1: testSamples(2, 1),
+		2: testSamples(3, 2),
+		3: testSamples(9, 3),
+		4: testSamples(1, 4),
+	}
+
+	// source 2 moves to a new chunk rather than being split, source 3 is
+	// larger than a chunk and has to be split
+	expected := []map[int]int{
+		{1: 2},
+		{2: 3, 3: 1},
+		{3: 4},
+		{3: 4},
+		{4: 1},
+	}
+	got := chunkSizes(splitSamples(metrics, 4))
+	if !cmp.Equal(expected, got) {
+		t.Fatal("unexpected chunks:", cmp.Diff(expected, got))
+	}
+
+	if got := splitSamples(metrics, 0); len(got) != 1 {
+		t.Fatal("metrics should not be split without a limit, chunks:", len(got))
+	}
+}
+
+func TestEncodeBounded(t *testing.T) {
+	metrics := map[int]prommodel.Vector{
+		1: testSamples(3, 1),
+		2: testSamples(1, 2),
+		3: testSamples(4, 3),
+	}
+
+	one, err := JSONEncoder{}.Encode(map[int]prommodel.Vector{1: testSamples(1, 1)})
+	if err != nil {
+		t.Fatal("encode:", err)
+	}
+
+	p := &MetricsPusher{encoder: JSONEncoder{}, maxBytes: 2 * len(one)}
+	payloads, err := p.encodeChunks(metrics)
+	if err != nil {
+		t.Fatal("encode chunks:", err)
+	}
+
+	nSamples := 0
+	for _, payload := range payloads {
+		if len(payload) > p.maxBytes {
+			t.Fatalf("payload of %d bytes exceeds the %d byte limit", len(payload), p.maxBytes)
+		}
+		var chunk map[int]prommodel.Vector
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			t.Fatal("decode payload:", err)
+		}
+		for _, vector := range chunk {
+			nSamples += len(vector)
+		}
+	}
+	if nSamples != 8 {
+		t.Fatal("samples were lost while splitting, got:", nSamples)
+	}
+}
+
+func TestPushChunks(t *testing.T) {
+	metrics := map[int]prommodel.Vector{
+		1: testSamples(2, 1),
+		2: testSamples(2, 2),
+		3: testSamples(2, 3),
+	}
+
+	var received []map[int]prommodel.Vector
+	var ids []string
+	failSource := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := decodeBody(t, r)
+		if _, fail := chunk[failSource]; fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, chunk)
+		ids = append(ids, r.Header.Get(InstanceIDHeader)+" "+r.Header.Get(BatchSeqHeader)+" "+r.Header.Get(BatchChunkHeader))
+	}))
+	defer server.Close()
+
+	policy := testRetryPolicy
+	policy.MaxAttempts = 1
+	pusher, err := NewMetricsPusher(server.URL, nil, WithEndpoint(server.URL),
+		WithRetryPolicy(policy), WithBatchLimits(0, 2), WithInstanceID("collector-1"))
+	if err != nil {
+		t.Fatal("new metrics pusher:", err)
+	}
+
+	err = pusher.PushBatch(context.Background(), 7, metrics)
+	partial, ok := err.(*PartialError)
+	if !ok {
+		t.Fatalf("expected a *PartialError, got: %#v", err)
+	}
+	if partial.Pushed != 1 || partial.Total != 3 {
+		t.Fatalf("unexpected partial push: %+v", partial)
+	}
+
+	// the retry skips the chunk that was already delivered
+	failSource = 0
+	if err := pusher.PushBatch(context.Background(), 7, metrics); err != nil {
+		t.Fatal("retry push:", err)
+	}
+
+	expected := []map[int]prommodel.Vector{
+		{1: metrics[1]},
+		{2: metrics[2]},
+		{3: metrics[3]},
+	}
+	if !cmp.Equal(expected, received) {
+		t.Fatal("unexpected pushed chunks:", cmp.Diff(expected, received))
+	}
+
+	expectedIDs := []string{"collector-1 7 1/3", "collector-1 7 2/3", "collector-1 7 3/3"}
+	if !cmp.Equal(expectedIDs, ids) {
+		t.Fatal("unexpected batch headers:", cmp.Diff(expectedIDs, ids))
+	}
+}
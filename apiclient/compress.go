@@ -0,0 +1,79 @@
+package apiclient
+
+import (
+	"bytes"
+	"compress/gzip"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Encodings that push request bodies can be compressed with.
+const (
+	EncodingNone = "none"
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// compressor compresses request bodies, sent with the given Content-Encoding.
+type compressor struct {
+	encoding string
+	level    int
+}
+
+func newCompressor(encoding string, level int) (*compressor, error) {
+	switch encoding {
+	case "", EncodingNone:
+		return nil, nil
+	case EncodingGzip:
+		if level != 0 && (level < gzip.HuffmanOnly || level > gzip.BestCompression) {
+			return nil, errors.Errorf("invalid gzip compression level: %d", level)
+		}
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+	case EncodingZstd:
+		if level < 0 || level > 22 {
+			return nil, errors.Errorf("invalid zstd compression level: %d", level)
+		}
+		if level == 0 {
+			level = 3
+		}
+	default:
+		return nil, errors.Errorf("unsupported compression: %s", encoding)
+	}
+
+	return &compressor{encoding: encoding, level: level}, nil
+}
+
+func (c *compressor) compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch c.encoding {
+	case EncodingGzip:
+		w, err := gzip.NewWriterLevel(&buf, c.level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+	case EncodingZstd:
+		w, err := zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
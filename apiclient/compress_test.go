@@ -0,0 +1,125 @@
+package apiclient
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+	prommodel "github.com/prometheus/common/model"
+)
+
+func decodeBody(t *testing.T, r *http.Request) map[int]prommodel.Vector {
+	t.Helper()
+
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case EncodingGzip:
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal("gzip reader:", err)
+		}
+		body = gz
+	case EncodingZstd:
+		zr, err := zstd.NewReader(r.Body)
+		if err != nil {
+			t.Fatal("zstd reader:", err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		t.Fatal("unexpected content encoding:", r.Header.Get("Content-Encoding"))
+	}
+
+	var metrics map[int]prommodel.Vector
+	if err := json.NewDecoder(body).Decode(&metrics); err != nil {
+		t.Fatal("decode request body:", err)
+	}
+
+	return metrics
+}
+
+func TestPushCompression(t *testing.T) {
+	metrics := map[int]prommodel.Vector{
+		1: prommodel.Vector{
+			&prommodel.Sample{
+				Timestamp: epoch,
+				Value:     prommodel.SampleValue(13.3),
+				Metric: prommodel.Metric{
+					"__name__": "joeblow",
+				},
+			},
+		},
+	}
+
+	var cases = []struct {
+		name      string
+		encoding  string
+		level     int
+		refuse    bool
+		nCalls    int
+		encodings []string
+	}{
+		{name: "uncompressed", encoding: EncodingNone, nCalls: 1, encodings: []string{""}},
+		{name: "gzip", encoding: EncodingGzip, level: 9, nCalls: 1, encodings: []string{"gzip"}},
+		{name: "zstd", encoding: EncodingZstd, nCalls: 1, encodings: []string{"zstd"}},
+		{name: "falls back when refused", encoding: EncodingZstd, refuse: true, nCalls: 3, encodings: []string{"zstd", "", ""}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var encodings []string
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				encoding := r.Header.Get("Content-Encoding")
+				encodings = append(encodings, encoding)
+
+				if tc.refuse && encoding != "" {
+					w.WriteHeader(http.StatusUnsupportedMediaType)
+					return
+				}
+
+				if got := decodeBody(t, r); !cmp.Equal(metrics, got) {
+					t.Fatal("unexpected input:", cmp.Diff(metrics, got))
+				}
+			}
+
+			fixture, tearDown := setup(t, handler, tc.nCalls)
+			defer tearDown(t)
+
+			pusher, err := NewMetricsPusher(fixture.server.URL, &refreshingToken{}, WithCompression(tc.encoding, tc.level))
+			if err != nil {
+				t.Fatal("new metrics pusher:", err)
+			}
+
+			if err := pusher.Push(fixture.ctx, metrics); err != nil {
+				t.Fatal("push metrics:", err)
+			}
+			if tc.refuse {
+				// compression stays off after the API refused it
+				if err := pusher.Push(fixture.ctx, metrics); err != nil {
+					t.Fatal("push metrics after fallback:", err)
+				}
+			}
+
+			if !cmp.Equal(tc.encodings, encodings) {
+				t.Fatal("unexpected content encodings:", cmp.Diff(tc.encodings, encodings))
+			}
+		})
+	}
+}
+
+func TestInvalidCompression(t *testing.T) {
+	for _, opt := range []PusherOption{
+		WithCompression("brotli", 0),
+		WithCompression(EncodingGzip, 42),
+		WithCompression(EncodingZstd, -1),
+	} {
+		if _, err := NewMetricsPusher("http://localhost", &refreshingToken{}, opt); err == nil {
+			t.Fatal("expected invalid compression to be rejected")
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package apiclient
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Push formats.
+const (
+	FormatJSON        = "json"
+	FormatRemoteWrite = "remote_write"
+)
+
+// DefaultSourceLabel is the label that carries the source ID in remote-write
+// output.
+const DefaultSourceLabel = "mindsight_source_id"
+
+// Encoder turns a batch of metrics into a push request body.
+type Encoder interface {
+	Encode(metrics map[int]prommodel.Vector) ([]byte, error)
+	// Headers describes the encoded body, e.g. its Content-Type. A body that
+	// sets its own Content-Encoding is never compressed again.
+	Headers() map[string]string
+}
+
+// NewEncoder returns the encoder for the given push format.
+func NewEncoder(format string) (Encoder, error) {
+	switch format {
+	case "", FormatJSON:
+		return JSONEncoder{}, nil
+	case FormatRemoteWrite:
+		return RemoteWriteEncoder{SourceLabel: DefaultSourceLabel}, nil
+	}
+
+	return nil, errors.Errorf("unsupported push format: %s", format)
+}
+
+// JSONEncoder encodes metrics as the JSON object keyed by source ID that the
+// Mindsight API expects.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(metrics map[int]prommodel.Vector) ([]byte, error) {
+	return json.Marshal(metrics)
+}
+
+func (JSONEncoder) Headers() map[string]string {
+	return map[string]string{"Content-Type": "application/json"}
+}
+
+// RemoteWriteEncoder encodes metrics as a snappy-compressed Prometheus
+// remote-write WriteRequest. The samples of each series of a source are sent
+// as one time series, in timestamp order, with the source ID attached as the
+// SourceLabel label.
+type RemoteWriteEncoder struct {
+	SourceLabel string
+}
+
+func (e RemoteWriteEncoder) Encode(metrics map[int]prommodel.Vector) ([]byte, error) {
+	// sorted so the same batch always encodes the same way
+	ids := make([]int, 0, len(metrics))
+	for id := range metrics {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var req prompb.WriteRequest
+	for _, id := range ids {
+		// series are kept in the order they first appear in
+		series := make(map[prommodel.Fingerprint]int)
+		first := len(req.Timeseries)
+
+		for _, sample := range metrics[id] {
+			fp := sample.Metric.Fingerprint()
+			i, present := series[fp]
+			if !present {
+				i = len(req.Timeseries)
+				series[fp] = i
+				req.Timeseries = append(req.Timeseries, prompb.TimeSeries{Labels: e.labels(id, sample.Metric)})
+			}
+
+			req.Timeseries[i].Samples = append(req.Timeseries[i].Samples, prompb.Sample{
+				Value:     float64(sample.Value),
+				Timestamp: int64(sample.Timestamp),
+			})
+		}
+
+		for _, ts := range req.Timeseries[first:] {
+			sort.SliceStable(ts.Samples, func(i, j int) bool {
+				return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+			})
+		}
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal write request")
+	}
+
+	return snappy.Encode(nil, data), nil
+}
+
+func (RemoteWriteEncoder) Headers() map[string]string {
+	return map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	}
+}
+
+// labels converts a metric to remote-write labels, sorted by name as the
+// protocol requires.
+func (e RemoteWriteEncoder) labels(sourceID int, metric prommodel.Metric) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(metric)+1)
+	for name, value := range metric {
+		if string(name) == e.SourceLabel {
+			continue
+		}
+		labels = append(labels, prompb.Label{Name: string(name), Value: string(value)})
+	}
+	labels = append(labels, prompb.Label{Name: e.SourceLabel, Value: strconv.Itoa(sourceID)})
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+
+	return labels
+}
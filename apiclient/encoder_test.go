@@ -0,0 +1,132 @@
+package apiclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/google/go-cmp/cmp"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestRemoteWriteEncoder(t *testing.T) {
+	metrics := map[int]prommodel.Vector{
+		2: prommodel.Vector{
+			&prommodel.Sample{
+				Timestamp: epoch,
+				Value:     prommodel.SampleValue(14.4),
+				Metric: prommodel.Metric{
+					"__name__": "gomie",
+					"instance": "a-host",
+				},
+			},
+		},
+		1: prommodel.Vector{
+			&prommodel.Sample{
+				Timestamp: epoch.Add(time.Minute),
+				Value:     prommodel.SampleValue(13.4),
+				Metric: prommodel.Metric{
+					"__name__": "joeblow",
+				},
+			},
+			&prommodel.Sample{
+				Timestamp: epoch,
+				Value:     prommodel.SampleValue(1),
+				Metric: prommodel.Metric{
+					"__name__": "joeblow",
+					"instance": "a-host",
+				},
+			},
+			&prommodel.Sample{
+				Timestamp: epoch,
+				Value:     prommodel.SampleValue(13.3),
+				Metric: prommodel.Metric{
+					"__name__": "joeblow",
+				},
+			},
+		},
+	}
+
+	expected := prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: "joeblow"},
+					{Name: DefaultSourceLabel, Value: "1"},
+				},
+				Samples: []prompb.Sample{{Value: 13.3, Timestamp: 10000}, {Value: 13.4, Timestamp: 70000}},
+			},
+			{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: "joeblow"},
+					{Name: "instance", Value: "a-host"},
+					{Name: DefaultSourceLabel, Value: "1"},
+				},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 10000}},
+			},
+			{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: "gomie"},
+					{Name: "instance", Value: "a-host"},
+					{Name: DefaultSourceLabel, Value: "2"},
+				},
+				Samples: []prompb.Sample{{Value: 14.4, Timestamp: 10000}},
+			},
+		},
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/push" {
+			t.Fatalf("wrong path got: %s expected: /api/v1/push", r.URL.Path)
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Fatal("unexpected content encoding:", r.Header.Get("Content-Encoding"))
+		}
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Fatal("unexpected content type:", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Fatal("didn't expect an authorization header without auth")
+		}
+
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal("read request body:", err)
+		}
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Fatal("snappy decode:", err)
+		}
+
+		var req prompb.WriteRequest
+		if err := req.Unmarshal(data); err != nil {
+			t.Fatal("unmarshal write request:", err)
+		}
+		if !cmp.Equal(expected, req) {
+			t.Fatal("unexpected write request:", cmp.Diff(expected, req))
+		}
+	}
+
+	fixture, tearDown := setup(t, handler, 1)
+	defer tearDown(t)
+
+	encoder, err := NewEncoder(FormatRemoteWrite)
+	if err != nil {
+		t.Fatal("new encoder:", err)
+	}
+
+	pusher, err := NewMetricsPusher(fixture.server.URL, nil,
+		WithEncoder(encoder),
+		WithEndpoint(fixture.server.URL+"/api/v1/push"),
+		WithCompression(EncodingGzip, 0))
+	if err != nil {
+		t.Fatal("new metrics pusher:", err)
+	}
+
+	if err := pusher.Push(fixture.ctx, metrics); err != nil {
+		t.Fatal("push metrics:", err)
+	}
+}
@@ -0,0 +1,207 @@
+package apiclient
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how MetricsPusher retries failed pushes. The wait
+// before retry n is InitialBackoff * Multiplier^(n-1), capped at MaxBackoff
+// and randomized by +/- Jitter (a fraction of the wait). A Retry-After header
+// sent by the API takes precedence over the computed wait, but is capped at
+// MaxBackoff too. Each attempt is abandoned, and may be retried, after
+// AttemptTimeout (zero means no timeout).
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	AttemptTimeout time.Duration
+}
+
+// DefaultRetryPolicy is used by a MetricsPusher unless WithRetryPolicy is given.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	AttemptTimeout: 30 * time.Second,
+}
+
+type singleAttemptKey struct{}
+
+// SingleAttempt returns a copy of ctx under which pushes aren't retried, for
+// data that's kept until it's delivered anyway, such as spooled batches. A
+// token the API rejected is still refreshed once.
+func SingleAttempt(ctx context.Context) context.Context {
+	return context.WithValue(ctx, singleAttemptKey{}, true)
+}
+
+// maxAttempts returns how many times a push under ctx may be attempted.
+func (r RetryPolicy) maxAttempts(ctx context.Context) int {
+	if single, _ := ctx.Value(singleAttemptKey{}).(bool); single {
+		return 1
+	}
+
+	return r.MaxAttempts
+}
+
+type retryUntilKey struct{}
+
+// RetryUntil returns a copy of ctx under which pushes aren't retried after
+// deadline. Unlike a deadline on ctx itself, it never cuts an attempt short.
+func RetryUntil(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, retryUntilKey{}, deadline)
+}
+
+// canRetryAt reports whether a push under ctx may be retried at the given
+// time: before ctx's deadline, and any set by RetryUntil.
+func canRetryAt(ctx context.Context, at time.Time) bool {
+	if deadline, ok := ctx.Deadline(); ok && !at.Before(deadline) {
+		return false
+	}
+	if deadline, ok := ctx.Value(retryUntilKey{}).(time.Time); ok && at.After(deadline) {
+		return false
+	}
+
+	return true
+}
+
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := r.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	wait := float64(r.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if r.MaxBackoff > 0 && wait > float64(r.MaxBackoff) {
+		wait = float64(r.MaxBackoff)
+	}
+
+	if r.Jitter > 0 {
+		wait *= 1 - r.Jitter + 2*r.Jitter*rand.Float64()
+	}
+
+	return time.Duration(wait)
+}
+
+// wait returns how long to wait before retrying after the given attempt,
+// honoring a wait requested by the API.
+func (r RetryPolicy) wait(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter <= 0 {
+		return r.backoff(attempt)
+	}
+	if r.MaxBackoff > 0 && retryAfter > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+
+	return retryAfter
+}
+
+// StatusError is returned when the API answers a request with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	// RetryAfter is the wait requested by the API's Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("response status: %s, body: %s", e.Status, e.Body)
+}
+
+// Retryable reports whether the request may succeed if it's sent again.
+func (e *StatusError) Retryable() bool {
+	switch {
+	case e.StatusCode == http.StatusRequestTimeout:
+		return true
+	case e.StatusCode == http.StatusTooManyRequests:
+		return true
+	case e.StatusCode >= 500:
+		return true
+	}
+
+	return false
+}
+
+// Rejected reports whether the API refused the request for its content, which
+// sending the same data again can't fix. Other failures, such as the
+// credentials being refused, may go away without the data changing.
+func (e *StatusError) Rejected() bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+
+	return false
+}
+
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Cause() error {
+	return e.error
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent reports whether err is a push failure that retrying the same
+// data will never fix, such as the API rejecting the request as malformed.
+// Refused credentials aren't permanent: the data has to be kept until they are
+// fixed.
+func IsPermanent(err error) bool {
+	for err != nil {
+		if _, ok := err.(permanentError); ok {
+			return true
+		}
+
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an
+// HTTP date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(header); err == nil {
+		return when.Sub(now)
+	}
+
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,239 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/MindsightCo/collector/cache"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const metricSourcesSubscription = `subscription {
+	metricSources {
+		id
+		sourceURL
+		query
+		interval
+		mode
+		step
+	}
+}`
+
+// graphql-ws protocol (subscriptions-transport-ws) message types
+const (
+	gqlSubprotocol         = "graphql-ws"
+	gqlConnectionInit      = "connection_init"
+	gqlConnectionAck       = "connection_ack"
+	gqlConnectionError     = "connection_error"
+	gqlConnectionTerminate = "connection_terminate"
+	gqlKeepAlive           = "ka"
+	gqlStart               = "start"
+	gqlStop                = "stop"
+	gqlData                = "data"
+	gqlError               = "error"
+	gqlComplete            = "complete"
+
+	subscriptionID = "1"
+)
+
+var (
+	subscriptionHandshakeTimeout = time.Second * 10
+	// the API is pinged regularly, a connection that has been silent for
+	// longer than subscriptionReadTimeout is considered dead
+	subscriptionPingInterval = time.Second * 30
+	subscriptionReadTimeout  = time.Minute
+)
+
+type gqlMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type gqlPayload struct {
+	Data   map[string][]cache.Source `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// Subscription receives metric source updates as the API publishes them.
+type Subscription struct {
+	// Updates receives the complete list of sources every time it changes.
+	// It is closed when the subscription ends, Err then tells why.
+	Updates <-chan []cache.Source
+
+	conn   *websocket.Conn
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// SubscribeSources subscribes to changes of the metric sources, using the
+// graphql-ws protocol over a websocket. It returns once the API has accepted
+// the subscription.
+func (q *Queryer) SubscribeSources(ctx context.Context) (*Subscription, error) {
+	authToken, err := q.auth.GetAccessToken()
+	if err != nil {
+		return nil, errors.Wrap(err, "get auth token")
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: subscriptionHandshakeTimeout,
+		Subprotocols:     []string{gqlSubprotocol},
+	}
+	header := http.Header{"Authorization": {"bearer " + authToken}}
+
+	conn, _, err := dialer.DialContext(ctx, q.addr.subscriptionAddr(), header)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial subscription")
+	}
+
+	if err := startSubscription(conn, authToken); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	updates := make(chan []cache.Source)
+	s := &Subscription{
+		Updates: updates,
+		conn:    conn,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go s.keepAlive(ctx)
+	go s.read(ctx, updates)
+
+	return s, nil
+}
+
+// Err returns why the subscription ended. It's only valid once Updates has
+// been closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// startSubscription initializes the graphql-ws connection and starts the
+// metric sources subscription on it.
+func startSubscription(conn *websocket.Conn, authToken string) error {
+	conn.SetReadDeadline(time.Now().Add(subscriptionHandshakeTimeout))
+	conn.SetWriteDeadline(time.Now().Add(subscriptionHandshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	initPayload, _ := json.Marshal(map[string]string{"Authorization": "bearer " + authToken})
+	if err := conn.WriteJSON(gqlMessage{Type: gqlConnectionInit, Payload: initPayload}); err != nil {
+		return errors.Wrap(err, "init subscription connection")
+	}
+
+	for acked := false; !acked; {
+		var msg gqlMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return errors.Wrap(err, "wait for subscription connection ack")
+		}
+
+		switch msg.Type {
+		case gqlConnectionAck:
+			acked = true
+		case gqlConnectionError:
+			return errors.Errorf("subscription connection refused: %s", msg.Payload)
+		}
+	}
+
+	startPayload, _ := json.Marshal(map[string]string{"query": metricSourcesSubscription})
+	if err := conn.WriteJSON(gqlMessage{ID: subscriptionID, Type: gqlStart, Payload: startPayload}); err != nil {
+		return errors.Wrap(err, "start subscription")
+	}
+
+	return nil
+}
+
+// read delivers the updates sent by the API until the subscription ends.
+func (s *Subscription) read(ctx context.Context, updates chan<- []cache.Source) {
+	defer close(s.done)
+	defer close(updates)
+	defer s.cancel()
+
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(subscriptionReadTimeout))
+	})
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(subscriptionReadTimeout))
+
+		var msg gqlMessage
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			if ctx.Err() != nil {
+				s.err = ctx.Err()
+			} else {
+				s.err = errors.Wrap(err, "read subscription")
+			}
+			return
+		}
+
+		switch msg.Type {
+		case gqlData:
+			var payload gqlPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				s.err = errors.Wrap(err, "json unmarshal subscription data")
+				return
+			}
+			if len(payload.Errors) > 0 {
+				s.err = errors.Errorf("subscription error: %s", payload.Errors[0].Message)
+				return
+			}
+
+			select {
+			case updates <- payload.Data["metricSources"]:
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				return
+			}
+
+		case gqlError, gqlConnectionError:
+			s.err = errors.Errorf("subscription error: %s", msg.Payload)
+			return
+
+		case gqlComplete:
+			s.err = errors.New("subscription ended by the API")
+			return
+		}
+	}
+}
+
+// keepAlive pings the API until the subscription ends, then closes the
+// connection.
+func (s *Subscription) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(subscriptionPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(subscriptionHandshakeTimeout)
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				s.conn.Close()
+				return
+			}
+
+		case <-ctx.Done():
+			// be polite, the connection is closed either way
+			s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			s.conn.WriteJSON(gqlMessage{ID: subscriptionID, Type: gqlStop})
+			s.conn.WriteJSON(gqlMessage{Type: gqlConnectionTerminate})
+			s.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package apiclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/MindsightCo/collector/cache"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/gorilla/websocket"
+)
+
+// subscriptionServer stands in for the API's graphql-ws endpoint. It accepts
+// the subscription, then sends each of updates (raw data payloads) and ends
+// the subscription.
+func subscriptionServer(t *testing.T, refuse bool, updates ...string) http.HandlerFunc {
+	upgrader := websocket.Upgrader{Subprotocols: []string{gqlSubprotocol}}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query" {
+			t.Errorf("wrong path got: %s expected: /query", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "bearer "+testToken {
+			t.Errorf("auth header got: ``%s'' expected: ``bearer %s''", r.Header.Get("Authorization"), testToken)
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error("upgrade to websocket:", err)
+			return
+		}
+		defer conn.Close()
+
+		if conn.Subprotocol() != gqlSubprotocol {
+			t.Error("unexpected subprotocol:", conn.Subprotocol())
+		}
+
+		var msg gqlMessage
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != gqlConnectionInit {
+			t.Errorf("expected connection_init, got: %+v (%v)", msg, err)
+			return
+		}
+
+		if refuse {
+			conn.WriteJSON(gqlMessage{Type: gqlConnectionError, Payload: json.RawMessage(`{"message":"go away"}`)})
+			return
+		}
+
+		conn.WriteJSON(gqlMessage{Type: gqlKeepAlive})
+		conn.WriteJSON(gqlMessage{Type: gqlConnectionAck})
+
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != gqlStart || msg.ID != subscriptionID {
+			t.Errorf("expected start, got: %+v (%v)", msg, err)
+			return
+		}
+
+		var start struct {
+			Query string `json:"query"`
+		}
+		json.Unmarshal(msg.Payload, &start)
+		if start.Query != metricSourcesSubscription {
+			t.Errorf("graphql subscription got: ``%s'' expected: ``%s''", start.Query, metricSourcesSubscription)
+		}
+
+		for _, update := range updates {
+			conn.WriteJSON(gqlMessage{ID: subscriptionID, Type: gqlData, Payload: json.RawMessage(update)})
+			conn.WriteJSON(gqlMessage{Type: gqlKeepAlive})
+		}
+		conn.WriteJSON(gqlMessage{ID: subscriptionID, Type: gqlComplete})
+
+		// wait for the client to hang up
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestSubscribeSources(t *testing.T) {
+	expSources := [][]cache.Source{
+		{
+			{SourceID: 1, URL: "http://source-1", Query: "up"},
+		},
+		{
+			{SourceID: 1, URL: "http://source-1", Query: "up"},
+			{SourceID: 2, URL: "http://source-2", Query: "down", Mode: cache.ModeRange},
+		},
+	}
+
+	handler := subscriptionServer(t, false,
+		`{"data":{"metricSources":[{"id":1,"sourceURL":"http://source-1","query":"up"}]}}`,
+		`{"data":{"metricSources":[{"id":1,"sourceURL":"http://source-1","query":"up"},{"id":2,"sourceURL":"http://source-2","query":"down","mode":"range"}]}}`)
+
+	fixture, tearDown := setup(t, handler, 1)
+	defer tearDown(t)
+
+	fixture.token.EXPECT().GetAccessToken().Return(testToken, nil)
+
+	q, err := NewQueryer(fixture.server.URL, fixture.token)
+	if err != nil {
+		t.Fatal("new queryer:", err)
+	}
+
+	sub, err := q.SubscribeSources(fixture.ctx)
+	if err != nil {
+		t.Fatal("subscribe sources:", err)
+	}
+	defer sub.Close()
+
+	var got [][]cache.Source
+	for sources := range sub.Updates {
+		got = append(got, sources)
+	}
+
+	ign := cmpopts.IgnoreUnexported(cache.Source{})
+	if !cmp.Equal(expSources, got, ign) {
+		t.Fatal("unexpected source updates:", cmp.Diff(expSources, got, ign))
+	}
+	if sub.Err() == nil {
+		t.Fatal("expected an error once the subscription ended")
+	}
+}
+
+func TestSubscribeSourcesRefused(t *testing.T) {
+	fixture, tearDown := setup(t, subscriptionServer(t, true), 1)
+	defer tearDown(t)
+
+	fixture.token.EXPECT().GetAccessToken().Return(testToken, nil)
+
+	q, err := NewQueryer(fixture.server.URL, fixture.token)
+	if err != nil {
+		t.Fatal("new queryer:", err)
+	}
+
+	if _, err := q.SubscribeSources(fixture.ctx); err == nil {
+		t.Fatal("expected an error when the API refuses the subscription")
+	}
+}
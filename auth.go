@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/MindsightCo/collector/telemetry"
+	auth0grant "github.com/ereyes01/go-auth0-grant"
+)
+
+// grantAuth hands out Auth0 access tokens for the API clients. Unlike a bare
+// auth0grant.Grant, it can throw away a cached token that the API rejected
+// and request a fresh one.
+type grantAuth struct {
+	mu        sync.Mutex
+	tokenURL  string
+	request   auth0grant.CredentialsRequest
+	grant     *auth0grant.Grant
+	lastToken string
+}
+
+func newGrantAuth(tokenURL string, request auth0grant.CredentialsRequest) *grantAuth {
+	return &grantAuth{
+		tokenURL: tokenURL,
+		request:  request,
+		grant:    auth0grant.NewGrant(tokenURL, request),
+	}
+}
+
+func (a *grantAuth) GetAccessToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.token()
+}
+
+func (a *grantAuth) RefreshAccessToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.grant = auth0grant.NewGrant(a.tokenURL, a.request)
+	return a.token()
+}
+
+// token gets a token from the grant, counting each time a new one is issued.
+func (a *grantAuth) token() (string, error) {
+	token, err := a.grant.GetAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	if token != a.lastToken {
+		telemetry.TokenRefreshes.Inc()
+		a.lastToken = token
+	}
+
+	return token, nil
+}
+
+// replace switches to other's credentials, along with any token already
+// issued for them, so every client sharing a picks them up.
+func (a *grantAuth) replace(other *grantAuth) {
+	other.mu.Lock()
+	request, grant := other.request, other.grant
+	other.mu.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.request = request
+	a.grant = grant
+}
@@ -2,96 +2,983 @@ package cache
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	promclient "github.com/MindsightCo/collector/prometheus_client"
+	"github.com/MindsightCo/collector/telemetry"
 	"github.com/pkg/errors"
 	prommodel "github.com/prometheus/common/model"
 )
 
 type queryer interface {
 	Query(ctx context.Context, query string) (prommodel.Vector, error)
+	QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) (prommodel.Matrix, error)
 }
 
+const (
+	// ModeInstant sources run an instant query each time they're scraped.
+	ModeInstant = "instant"
+	// ModeRange sources run a range query covering everything since their
+	// last successful scrape, so gaps from outages or restarts are
+	// backfilled.
+	ModeRange = "range"
+
+	// AbsentMetricName names the marker sample recorded for a source whose
+	// query matched no series, when absence markers are enabled.
+	AbsentMetricName = "mindsight_no_data"
+)
+
+// Source is a prometheus query to collect. It is decoded from the API's JSON,
+// and from the collector's configuration with the same field names, e.g. in
+// YAML:
+//
+//	sources:
+//	  - id: 7
+//	    sourceURL: http://prometheus:9090
+//	    query: sum(rate(http_requests_total[5m])) by (job)
+//	    interval: 1m
 type Source struct {
-	SourceID int    `json:"id"`
-	URL      string `json:"sourceURL"`
-	Query    string `json:"query"`
-	client   queryer
+	SourceID int    `json:"id" mapstructure:"id"`
+	URL      string `json:"sourceURL" mapstructure:"sourceURL"`
+	Query    string `json:"query" mapstructure:"query"`
+	// Interval is how often the source is queried. Zero means the cache's
+	// default interval.
+	Interval time.Duration `json:"interval" mapstructure:"interval"`
+	// Mode is ModeInstant (the default) or ModeRange.
+	Mode string `json:"mode" mapstructure:"mode"`
+	// Step is the resolution of range queries. Zero means the source's
+	// interval.
+	Step time.Duration `json:"step" mapstructure:"step"`
+	// Connection names the connection profile used to reach URL. If empty,
+	// a profile whose URL is a prefix of the source's URL is used, if any.
+	Connection string `json:"connection" mapstructure:"connection"`
+	client     queryer
+	nextRun    time.Time
+}
+
+// Connection is a named profile of options for reaching prometheus servers.
+type Connection struct {
+	// URL, if set, makes the profile apply to every source whose URL starts
+	// with it (unless the source names another profile).
+	URL                string `mapstructure:"url"`
+	promclient.Options `mapstructure:",squash"`
+}
+
+// UnmarshalJSON decodes a source, accepting its interval and step either as
+// duration strings (e.g. "1m") or as numbers of seconds.
+func (s *Source) UnmarshalJSON(data []byte) error {
+	type plain Source
+	aux := struct {
+		*plain
+		Interval interface{} `json:"interval"`
+		Step     interface{} `json:"step"`
+	}{plain: (*plain)(s)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	var err error
+	if s.Interval, err = parseDuration(aux.Interval); err != nil {
+		return errors.Wrapf(err, "source %d interval", s.SourceID)
+	}
+	if s.Step, err = parseDuration(aux.Step); err != nil {
+		return errors.Wrapf(err, "source %d step", s.SourceID)
+	}
+
+	return nil
+}
+
+func parseDuration(value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return time.Duration(v * float64(time.Second)), nil
+	case string:
+		return time.ParseDuration(v)
+	}
+
+	return 0, errors.Errorf("invalid duration: %v", value)
+}
+
+// Validate checks that the source is complete enough to be scheduled. Sources
+// from the API are trusted, it's meant for sources configured locally.
+func (s Source) Validate() error {
+	if s.SourceID <= 0 {
+		return errors.Errorf("source id must be positive, got: %d", s.SourceID)
+	}
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return errors.Wrapf(err, "source %d url", s.SourceID)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("source %d: url must be an absolute http(s) url, got: %q", s.SourceID, s.URL)
+	}
+
+	if strings.TrimSpace(s.Query) == "" {
+		return errors.Errorf("source %d: empty query", s.SourceID)
+	}
+	// a query the parser doesn't know is left for the server to check
+	if _, err := CheckQuery(s.Query); err != nil && !IsParseError(err) {
+		return errors.Wrapf(err, "source %d", s.SourceID)
+	}
+
+	switch s.Mode {
+	case "", ModeInstant, ModeRange:
+	default:
+		return errors.Errorf("source %d: unknown mode: %q", s.SourceID, s.Mode)
+	}
+
+	if s.Interval < 0 {
+		return errors.Errorf("source %d: negative interval: %s", s.SourceID, s.Interval)
+	}
+	if s.Step < 0 {
+		return errors.Errorf("source %d: negative step: %s", s.SourceID, s.Step)
+	}
+
+	return nil
+}
+
+func (s Source) interval(defaultInterval time.Duration) time.Duration {
+	if s.Interval > 0 {
+		return s.Interval
+	}
+
+	return defaultInterval
 }
 
+// Cache buffers the results of source queries until they're flushed. It is
+// safe for concurrent use: sources can be replaced, the cache flushed and its
+// stats read while Collect is querying. The lock is not held while queries
+// run, and results of sources that were removed in the meantime are dropped.
 type Cache struct {
+	mu sync.Mutex
+
 	sources       []Source
 	values        map[int]prommodel.Vector
 	nCache, limit int
 	lastFlush     time.Time
 	timeLimit     time.Duration
 	nowFn         func() time.Time
+
+	// limits on queries running at once, in total and against any one
+	// prometheus server (zero means no limit)
+	concurrency, urlConcurrency int
+	queryTimeout                time.Duration
+
+	// interval for sources that don't specify their own (zero means every
+	// Collect call)
+	defaultInterval time.Duration
+
+	// end of the last successful query of each range mode source, and how
+	// far back a range query may reach
+	checkpoints map[int]time.Time
+	maxLookback time.Duration
+
+	// sources that matched no series in the last Collect, and whether to
+	// record a marker sample for them
+	noData         []int
+	absenceMarkers bool
+
+	connections map[string]Connection
+	clients     map[connKey]*promclient.PromClient
+
+	// sources kept out of the schedule because their query is invalid, and
+	// the queries of scheduled sources that couldn't be checked before
+	// querying their server
+	quarantine map[int]quarantinedSource
+	unverified map[int]string
+
+	// hard cap on the samples held, what to do when it's reached, and how
+	// many samples each source has had dropped because of it
+	maxSamples     int
+	overflowPolicy string
+	dropped        map[int]int
+}
+
+// Option configures optional Cache behavior.
+type Option func(*Cache)
+
+// WithConcurrency limits how many source queries run at the same time.
+func WithConcurrency(n int) Option {
+	return func(c *Cache) {
+		c.concurrency = n
+	}
+}
+
+// WithPerURLConcurrency limits how many queries run at the same time against
+// a single prometheus server.
+func WithPerURLConcurrency(n int) Option {
+	return func(c *Cache) {
+		c.urlConcurrency = n
+	}
+}
+
+// WithQueryTimeout bounds how long each source query may take.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(c *Cache) {
+		c.queryTimeout = timeout
+	}
 }
 
-func NewCache(sources []Source, size int, maxAge time.Duration) (*Cache, error) {
+// WithDefaultInterval sets how often sources without their own Interval are
+// queried.
+func WithDefaultInterval(interval time.Duration) Option {
+	return func(c *Cache) {
+		c.defaultInterval = interval
+	}
+}
+
+// WithMaxLookback limits how far back range mode sources backfill.
+func WithMaxLookback(lookback time.Duration) Option {
+	return func(c *Cache) {
+		c.maxLookback = lookback
+	}
+}
+
+// WithAbsenceMarkers records an AbsentMetricName sample for every source query
+// that matches no series, so that "no data" can be told apart from "not
+// collected".
+func WithAbsenceMarkers(enabled bool) Option {
+	return func(c *Cache) {
+		c.absenceMarkers = enabled
+	}
+}
+
+// WithConnections sets the connection profiles available to sources, by name.
+func WithConnections(connections map[string]Connection) Option {
+	return func(c *Cache) {
+		c.connections = connections
+	}
+}
+
+// SetSchedule changes the interval of sources that don't specify their own,
+// and the query timeout. Sources keep their next run time, the new interval
+// applies from then on.
+func (c *Cache) SetSchedule(defaultInterval, queryTimeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.defaultInterval = defaultInterval
+	c.queryTimeout = queryTimeout
+}
+
+func NewCache(sources []Source, size int, maxAge time.Duration, opts ...Option) (*Cache, error) {
 	c := &Cache{
-		limit:     size,
-		timeLimit: maxAge,
-		nowFn:     time.Now,
+		limit:       size,
+		timeLimit:   maxAge,
+		nowFn:       time.Now,
+		checkpoints: make(map[int]time.Time),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if err := ValidOverflowPolicy(c.overflowPolicy); err != nil {
+		return nil, err
 	}
 
-	if _, err := c.NewSources(sources); err != nil {
+	if _, _, err := c.NewSources(sources); err != nil {
 		return nil, errors.Wrap(err, "new cache set sources")
 	}
 
 	return c, nil
 }
 
-func (c *Cache) NewSources(sources []Source) (map[int]prommodel.Vector, error) {
-	conns := make(map[string]*promclient.PromClient)
+// NewSources replaces the cache's sources. Sources whose SourceID and
+// definition didn't change keep their schedule and any data already in the
+// cache, and clients are reused for prometheus servers that are still in use.
+// Sources with an invalid query are quarantined: they aren't scheduled until
+// they're replaced by a valid version. A query CheckQuery can't parse is
+// scheduled anyway, and only quarantined once its server rejects it too (see
+// Collect). The data of sources that were removed is returned, along with a
+// summary of the changes.
+func (c *Cache) NewSources(sources []Source) (map[int]prommodel.Vector, SourceChanges, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	check := checkQueries(sources, c.quarantine)
+	sources, quarantine, warnings := check.valid, check.quarantine, check.warnings
+
+	prev := make(map[int][]Source)
+	for _, src := range c.sources {
+		prev[src.SourceID] = append(prev[src.SourceID], src)
+	}
+	next := make(map[int][]Source)
+	for _, src := range sources {
+		next[src.SourceID] = append(next[src.SourceID], src)
+	}
+
+	clients := make(map[connKey]*promclient.PromClient)
+	seen := make(map[int]int)
 
 	sourcesCopy := append([]Source{}, sources...)
 	for idx, src := range sourcesCopy {
-		if client, present := conns[src.URL]; present {
+		profile, err := c.connectionFor(src)
+		if err != nil {
+			return nil, SourceChanges{}, err
+		}
+		key := connKey{url: src.URL, profile: profile}
+
+		if sameDefinitions(prev[src.SourceID], next[src.SourceID]) {
+			old := prev[src.SourceID][seen[src.SourceID]]
+			seen[src.SourceID]++
+
+			sourcesCopy[idx].client = old.client
+			sourcesCopy[idx].nextRun = old.nextRun
+			if client, ok := old.client.(*promclient.PromClient); ok && clients[key] == nil {
+				clients[key] = client
+			}
+			continue
+		}
+
+		if client, present := clients[key]; present {
 			sourcesCopy[idx].client = client
 			continue
 		}
+		if client, present := c.clients[key]; present {
+			sourcesCopy[idx].client = client
+			clients[key] = client
+			continue
+		}
 
-		client, err := promclient.NewPromClient(src.URL)
+		client, err := promclient.NewPromClientWithOptions(src.URL, c.connections[profile].Options)
 		if err != nil {
-			return nil, errors.Wrap(err, "connect to prometheus server")
+			return nil, SourceChanges{}, errors.Wrapf(err, "connect to prometheus server %s", src.URL)
 		}
 
 		sourcesCopy[idx].client = client
-		conns[src.URL] = client
+		clients[key] = client
 	}
 
-	prevValues := c.values
-	c.values = make(map[int]prommodel.Vector)
+	var changes SourceChanges
+	for id := range next {
+		if _, present := prev[id]; !present {
+			changes.Added = append(changes.Added, id)
+		} else if !sameDefinitions(prev[id], next[id]) {
+			changes.Modified = append(changes.Modified, id)
+		}
+	}
+	for id := range prev {
+		if _, present := next[id]; !present {
+			changes.Removed = append(changes.Removed, id)
+			delete(c.checkpoints, id)
+		}
+	}
+	sort.Ints(changes.Added)
+	sort.Ints(changes.Removed)
+	sort.Ints(changes.Modified)
+
+	for _, ids := range [][]int{changes.Added, changes.Modified} {
+		for _, id := range ids {
+			if len(warnings[id]) == 0 {
+				continue
+			}
+			if changes.Warnings == nil {
+				changes.Warnings = make(map[int][]string)
+			}
+			changes.Warnings[id] = warnings[id]
+		}
+	}
+	for id, q := range quarantine {
+		if prev, present := c.quarantine[id]; present && prev.query == q.query {
+			continue
+		}
+		if changes.Quarantined == nil {
+			changes.Quarantined = make(map[int]error)
+		}
+		changes.Quarantined[id] = q.err
+	}
+
+	// flush whatever isn't collected by any source anymore
+	var flushed map[int]prommodel.Vector
+	for id, vector := range c.values {
+		if _, present := next[id]; present {
+			continue
+		}
+		if flushed == nil {
+			flushed = make(map[int]prommodel.Vector)
+		}
+		flushed[id] = vector
+		c.nCache -= len(vector)
+		delete(c.values, id)
+	}
+
+	if c.values == nil {
+		c.values = make(map[int]prommodel.Vector)
+		c.lastFlush = c.nowFn()
+	}
 	c.sources = sourcesCopy
-	c.nCache = 0
-	c.lastFlush = c.nowFn()
+	c.clients = clients
+	c.quarantine = quarantine
+	c.unverified = check.unverified
+	telemetry.SourcesQuarantined.Set(float64(len(quarantine)))
+	telemetry.CacheDepth.Set(float64(c.nCache))
+
+	return flushed, changes, nil
+}
+
+// SourceChanges summarizes what NewSources changed, by SourceID.
+type SourceChanges struct {
+	Added, Removed, Modified []int
+	// Quarantined holds why each source newly quarantined was.
+	Quarantined map[int]error
+	// Warnings are CheckQuery's, for sources added or modified.
+	Warnings map[int][]string
+}
+
+// Changed reports whether any source was added, removed, modified or
+// quarantined.
+func (ch SourceChanges) Changed() bool {
+	return len(ch.Added) > 0 || len(ch.Removed) > 0 || len(ch.Modified) > 0 || len(ch.Quarantined) > 0
+}
+
+func (ch SourceChanges) String() string {
+	s := fmt.Sprintf("added: %v removed: %v modified: %v", ch.Added, ch.Removed, ch.Modified)
+	if len(ch.Quarantined) > 0 {
+		var ids []int
+		for id := range ch.Quarantined {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		s += fmt.Sprintf(" quarantined: %v", ids)
+	}
+
+	return s
+}
+
+// sameDefinitions reports whether two lists of sources with the same SourceID
+// query the same things, ignoring their clients and schedules.
+func sameDefinitions(a, b []Source) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for idx := range a {
+		x, y := a[idx], b[idx]
+		x.client, x.nextRun = nil, time.Time{}
+		y.client, y.nextRun = nil, time.Time{}
+		if x != y {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sources share a prometheus client when they have the same url and
+// connection profile
+type connKey struct {
+	url, profile string
+}
+
+// connectionFor returns the name of the connection profile src uses, or "" if
+// it doesn't use one. When several profiles match the source's URL, the one
+// with the longest URL wins.
+func (c *Cache) connectionFor(src Source) (string, error) {
+	if src.Connection != "" {
+		if _, present := c.connections[src.Connection]; !present {
+			return "", errors.Errorf("source %d: unknown connection profile %q", src.SourceID, src.Connection)
+		}
+		return src.Connection, nil
+	}
 
-	return prevValues, nil
+	var match string
+	for name, conn := range c.connections {
+		if conn.URL == "" || !strings.HasPrefix(src.URL, conn.URL) {
+			continue
+		}
+		if match == "" || len(conn.URL) > len(c.connections[match].URL) ||
+			(len(conn.URL) == len(c.connections[match].URL) && name < match) {
+			match = name
+		}
+	}
+
+	return match, nil
 }
 
+// Collect queries every source that is due to run and adds the results to the
+// cache. If the cache is full or too old, its contents are returned and the
+// cache is emptied.
+//
+// Sources are queried concurrently, within the cache's concurrency limits, but
+// results are always added in source order.
+//
+// A source whose query fails doesn't stop collection from the others; the
+// failures are reported in a *CollectError alongside whatever was flushed. A
+// query that matches no series isn't a failure, see NoData. A source whose
+// query couldn't be parsed by CheckQuery is quarantined if its server rejects
+// the query as well.
 func (c *Cache) Collect(ctx context.Context) (map[int]prommodel.Vector, error) {
+	var failures []*SourceError
+
+	c.mu.Lock()
+	now := c.nowFn()
+	due := c.due(now)
+	c.mu.Unlock()
+
+	queried := c.queryAll(ctx, due, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var spilled map[int]prommodel.Vector
+	current := make(map[int]bool, len(c.sources))
 	for _, src := range c.sources {
-		results, err := src.client.Query(ctx, src.Query)
-		if err != nil {
-			return nil, errors.Wrapf(err, "query: %s url: %s", src.Query, src.URL)
+		current[src.SourceID] = true
+	}
+	c.noData = nil
+
+	for idx, src := range due {
+		result := queried[idx]
+		if !current[src.SourceID] {
+			continue
+		}
+
+		sourceID := strconv.Itoa(src.SourceID)
+
+		if result.err != nil {
+			telemetry.QueryErrors.WithLabelValues(sourceID).Inc()
+			failure := &SourceError{
+				SourceID: src.SourceID,
+				URL:      src.URL,
+				Query:    src.Query,
+				Err:      result.err,
+			}
+			if c.unverified[src.SourceID] == src.Query && promclient.IsBadQuery(result.err) {
+				c.quarantineSource(src.SourceID, result.err)
+				failure.Quarantined = true
+			}
+			failures = append(failures, failure)
+			continue
 		}
 
-		c.values[src.SourceID] = append(c.values[src.SourceID], results...)
-		c.nCache += len(results)
+		if result.noData {
+			c.noData = append(c.noData, src.SourceID)
+			if c.absenceMarkers {
+				result.vector = prommodel.Vector{absenceMarker(now)}
+			}
+		}
+
+		if !result.end.IsZero() {
+			if c.checkpoints == nil {
+				c.checkpoints = make(map[int]time.Time)
+			}
+			c.checkpoints[src.SourceID] = result.end
+		}
+
+		if len(result.vector) > 0 {
+			telemetry.SamplesCollected.WithLabelValues(sourceID).Add(float64(len(result.vector)))
+			for id, vector := range c.add(src.SourceID, result.vector) {
+				if spilled == nil {
+					spilled = make(map[int]prommodel.Vector)
+				}
+				spilled[id] = append(spilled[id], vector...)
+			}
+		}
 	}
 
 	var flushed map[int]prommodel.Vector
 	deadline := c.lastFlush.Add(c.timeLimit)
-	now := c.nowFn()
 
 	if c.nCache >= c.limit || now.After(deadline) {
+		reason := telemetry.FlushAge
+		if c.nCache >= c.limit {
+			reason = telemetry.FlushSize
+		}
+		telemetry.CacheFlushes.WithLabelValues(reason).Inc()
+
 		flushed = c.values
 		c.values = make(map[int]prommodel.Vector)
 		c.nCache = 0
 		c.lastFlush = now
 	}
 
+	if spilled != nil {
+		if flushed == nil {
+			flushed = make(map[int]prommodel.Vector)
+		}
+		for id, vector := range spilled {
+			flushed[id] = append(vector, flushed[id]...)
+		}
+	}
+
+	telemetry.CacheDepth.Set(float64(c.nCache))
+
+	if len(failures) > 0 {
+		return flushed, &CollectError{Failures: failures, NSources: len(due)}
+	}
+
 	return flushed, nil
 }
+
+// quarantineSource takes the source with the given ID out of the schedule,
+// because its server rejected its query.
+func (c *Cache) quarantineSource(id int, err error) {
+	var sources []Source
+	for _, src := range c.sources {
+		if src.SourceID != id {
+			sources = append(sources, src)
+		}
+	}
+	c.sources = sources
+
+	c.quarantine[id] = quarantinedSource{query: c.unverified[id], err: err, confirmed: true}
+	delete(c.unverified, id)
+	telemetry.SourcesQuarantined.Set(float64(len(c.quarantine)))
+}
+
+// Flush empties the cache and returns its contents, regardless of how full or
+// old the cache is.
+func (c *Cache) Flush() map[int]prommodel.Vector {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flushed := c.values
+	c.values = make(map[int]prommodel.Vector)
+	c.nCache = 0
+	c.lastFlush = c.nowFn()
+	telemetry.CacheDepth.Set(0)
+
+	return flushed
+}
+
+// Stats describes what the cache holds.
+type Stats struct {
+	Sources   int
+	Samples   int
+	Limit     int
+	LastFlush time.Time
+	// Dropped counts, by source, the samples discarded because the cache
+	// was at its sample cap.
+	Dropped map[int]int
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dropped := make(map[int]int, len(c.dropped))
+	for id, n := range c.dropped {
+		dropped[id] = n
+	}
+
+	return Stats{
+		Sources:   len(c.sources),
+		Samples:   c.nCache,
+		Limit:     c.limit,
+		LastFlush: c.lastFlush,
+		Dropped:   dropped,
+	}
+}
+
+// NoData returns the IDs of the sources whose queries matched no series in the
+// last call to Collect.
+func (c *Cache) NoData() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]int{}, c.noData...)
+}
+
+func absenceMarker(now time.Time) *prommodel.Sample {
+	return &prommodel.Sample{
+		Metric: prommodel.Metric{
+			prommodel.MetricNameLabel: AbsentMetricName,
+		},
+		Value:     1,
+		Timestamp: prommodel.TimeFromUnixNano(now.UnixNano()),
+	}
+}
+
+// Checkpoints returns, for each range mode source, the time up to which it has
+// been collected.
+func (c *Cache) Checkpoints() map[int]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	checkpoints := make(map[int]time.Time, len(c.checkpoints))
+	for id, t := range c.checkpoints {
+		checkpoints[id] = t
+	}
+
+	return checkpoints
+}
+
+// RestoreCheckpoints sets where range mode sources resume collecting from, e.g.
+// with checkpoints saved before a restart.
+func (c *Cache) RestoreCheckpoints(checkpoints map[int]time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.checkpoints == nil {
+		c.checkpoints = make(map[int]time.Time)
+	}
+
+	for id, t := range checkpoints {
+		c.checkpoints[id] = t
+	}
+}
+
+type queryResult struct {
+	vector prommodel.Vector
+	// for range queries, the end of the range that was collected
+	end    time.Time
+	noData bool
+	err    error
+}
+
+// QuerySource runs the query of the source with the given ID once, outside of
+// its schedule, and returns the result without caching it. A range mode
+// source covers one interval back from now. promclient.ErrNoData is returned
+// if the query matched no series.
+func (c *Cache) QuerySource(ctx context.Context, id int) (prommodel.Vector, error) {
+	c.mu.Lock()
+	now := c.nowFn()
+	var src *dueSource
+	for _, s := range c.sources {
+		if s.SourceID == id {
+			period := s.interval(c.defaultInterval)
+			step := s.Step
+			if step <= 0 {
+				step = period
+			}
+			// the range query starts a step after the checkpoint
+			src = &dueSource{
+				Source:     s,
+				checkpoint: now.Add(-period - step),
+				period:     period,
+				timeout:    c.queryTimeout,
+			}
+			break
+		}
+	}
+	q, quarantined := c.quarantine[id]
+	c.mu.Unlock()
+
+	if src == nil {
+		if quarantined {
+			return nil, errors.Wrapf(q.err, "source %d is quarantined", id)
+		}
+		return nil, errors.Errorf("no source with id %d", id)
+	}
+
+	if src.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, src.timeout)
+		defer cancel()
+	}
+
+	result := c.query(ctx, *src, now)
+	if result.noData {
+		return nil, promclient.ErrNoData
+	}
+	return result.vector, errors.Wrapf(result.err, "source %d", id)
+}
+
+// NextRun returns when the next source is due to be queried. It returns false
+// if there are no sources.
+func (c *Cache) NextRun() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var next time.Time
+
+	for _, src := range c.sources {
+		if src.nextRun.IsZero() {
+			return c.nowFn(), true
+		}
+		if next.IsZero() || src.nextRun.Before(next) {
+			next = src.nextRun
+		}
+	}
+
+	return next, !next.IsZero()
+}
+
+// NextFlush returns when the cache becomes too old, and Collect flushes it
+// whether or not it's full.
+func (c *Cache) NextFlush() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastFlush.Add(c.timeLimit)
+}
+
+// dueSource is a source to query, with where a range query resumes from, and
+// its interval and query timeout as they were when it came due.
+type dueSource struct {
+	Source
+	checkpoint time.Time
+	period     time.Duration
+	timeout    time.Duration
+}
+
+// due returns the sources that should be queried at now, and schedules their
+// next run.
+func (c *Cache) due(now time.Time) []dueSource {
+	var due []dueSource
+
+	for idx := range c.sources {
+		src := &c.sources[idx]
+		if now.Before(src.nextRun) {
+			continue
+		}
+
+		interval := src.interval(c.defaultInterval)
+		due = append(due, dueSource{
+			Source:     *src,
+			checkpoint: c.checkpoints[src.SourceID],
+			period:     interval,
+			timeout:    c.queryTimeout,
+		})
+
+		// stay on the source's cadence, unless we've fallen a whole
+		// interval behind
+		next := src.nextRun.Add(interval)
+		if !next.After(now) {
+			next = now.Add(interval)
+		}
+		src.nextRun = next
+	}
+
+	return due
+}
+
+// queryAll runs the queries of the given sources, returning the results in the
+// same order.
+func (c *Cache) queryAll(ctx context.Context, sources []dueSource, now time.Time) []queryResult {
+	results := make([]queryResult, len(sources))
+
+	global := newSemaphore(c.concurrency)
+	perURL := make(map[string]semaphore)
+	for _, src := range sources {
+		if _, present := perURL[src.URL]; !present {
+			perURL[src.URL] = newSemaphore(c.urlConcurrency)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for idx, src := range sources {
+		wg.Add(1)
+
+		go func(idx int, src dueSource) {
+			defer wg.Done()
+
+			// take the per-server slot first, so a busy server doesn't hold
+			// up global slots that other servers could use
+			perURL[src.URL].acquire()
+			defer perURL[src.URL].release()
+			global.acquire()
+			defer global.release()
+
+			queryCtx := ctx
+			if src.timeout > 0 {
+				var cancel context.CancelFunc
+				queryCtx, cancel = context.WithTimeout(ctx, src.timeout)
+				defer cancel()
+			}
+
+			start := time.Now()
+			results[idx] = c.query(queryCtx, src, now)
+			telemetry.QueryDuration.WithLabelValues(strconv.Itoa(src.SourceID)).Observe(time.Since(start).Seconds())
+		}(idx, src)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// query runs a single source's query. Range mode sources query everything
+// since their checkpoint (limited by the maximum lookback), and the resulting
+// matrix is flattened into a vector of samples.
+func (c *Cache) query(ctx context.Context, src dueSource, now time.Time) queryResult {
+	if src.Mode != ModeRange {
+		vector, err := src.client.Query(ctx, src.Query)
+		if errors.Cause(err) == promclient.ErrNoData {
+			return queryResult{noData: true}
+		}
+		return queryResult{vector: vector, err: err}
+	}
+
+	step := src.Step
+	if step <= 0 {
+		step = src.period
+	}
+	if step <= 0 {
+		return queryResult{err: errors.New("range query needs a step or an interval")}
+	}
+
+	start := now
+	if !src.checkpoint.IsZero() {
+		start = src.checkpoint.Add(step)
+	}
+	if c.maxLookback > 0 && now.Sub(start) > c.maxLookback {
+		start = now.Add(-c.maxLookback)
+	}
+	if start.After(now) {
+		// nothing new to collect yet
+		return queryResult{}
+	}
+
+	matrix, err := src.client.QueryRange(ctx, src.Query, start, now, step)
+	if errors.Cause(err) == promclient.ErrNoData {
+		return queryResult{noData: true, end: now}
+	}
+	if err != nil {
+		return queryResult{err: err}
+	}
+
+	return queryResult{vector: flatten(matrix), end: now}
+}
+
+// flatten converts a range vector into a vector holding every one of its
+// samples.
+func flatten(matrix prommodel.Matrix) prommodel.Vector {
+	var vector prommodel.Vector
+
+	for _, stream := range matrix {
+		for _, pair := range stream.Values {
+			vector = append(vector, &prommodel.Sample{
+				Metric:    stream.Metric,
+				Value:     pair.Value,
+				Timestamp: pair.Timestamp,
+			})
+		}
+	}
+
+	return vector
+}
+
+// semaphore bounds concurrent work. A nil semaphore never blocks.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -2,12 +2,18 @@ package cache
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
 	"testing"
 	"time"
 
+	promclient "github.com/MindsightCo/collector/prometheus_client"
+	"github.com/MindsightCo/collector/telemetry"
 	gomock "github.com/golang/mock/gomock"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	prommodel "github.com/prometheus/common/model"
 )
 
@@ -22,67 +28,125 @@ func testNowElapsed() time.Time {
 }
 
 func TestNewSources(t *testing.T) {
-	prevValues := map[int]prommodel.Vector{
-		23: prommodel.Vector{
-			&prommodel.Sample{
-				Timestamp: 0,
-				Value:     prommodel.SampleValue(13.3),
-				Metric: prommodel.Metric{
-					"__name__": "joeblow",
-				},
-			},
+	sample := &prommodel.Sample{
+		Timestamp: 0,
+		Value:     prommodel.SampleValue(13.3),
+		Metric: prommodel.Metric{
+			"__name__": "joeblow",
 		},
 	}
 
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+	mockQueryer := NewMockqueryer(ctl)
+	nextRun := testNow().Add(time.Minute)
+	lastFlush := testNow().Add(-time.Minute)
+
 	c := &Cache{
-		sources: []Source{{SourceID: 2}},
-		values:  prevValues,
-		nowFn:   testNow,
-		nCache:  1,
-		limit:   10,
+		sources: []Source{
+			{SourceID: 2, URL: "kept", Query: `up{job="a"}`, client: mockQueryer, nextRun: nextRun},
+			{SourceID: 5, URL: "gone", Query: `up{job="a"}`},
+		},
+		values: map[int]prommodel.Vector{
+			2:  prommodel.Vector{sample},
+			5:  prommodel.Vector{sample},
+			23: prommodel.Vector{sample},
+		},
+		checkpoints: map[int]time.Time{5: testNow()},
+		nowFn:       testNow,
+		nCache:      3,
+		limit:       10,
+		lastFlush:   lastFlush,
 	}
 
 	newSources := []Source{
-		{SourceID: 1, URL: "blah"},
-		{SourceID: 2, URL: "a-url"},
-		{SourceID: 3, URL: "a-url"},
+		{SourceID: 1, URL: "blah", Query: `up{job="a"}`},
+		{SourceID: 2, URL: "kept", Query: `up{job="a"}`},
+		{SourceID: 3, URL: "a-url", Query: `up{job="a"}`},
+		{SourceID: 4, URL: "a-url", Query: `up{job="a"}`},
 	}
 
-	values, err := c.NewSources(newSources)
+	flushed, changes, err := c.NewSources(newSources)
 	if err != nil {
 		t.Fatal("set new sources:", err)
 	}
-	if !cmp.Equal(values, prevValues) {
-		t.Fatalf("unexpected values returned, diff: %s", cmp.Diff(values, prevValues))
+
+	expFlushed := map[int]prommodel.Vector{
+		5:  prommodel.Vector{sample},
+		23: prommodel.Vector{sample},
+	}
+	if !cmp.Equal(expFlushed, flushed) {
+		t.Fatal("unexpected values flushed:", cmp.Diff(expFlushed, flushed))
 	}
 
-	ignoreUnexp := cmpopts.IgnoreUnexported(Source{})
+	expChanges := SourceChanges{Added: []int{1, 3, 4}, Removed: []int{5}}
+	if !cmp.Equal(expChanges, changes) {
+		t.Fatal("unexpected source changes:", cmp.Diff(expChanges, changes))
+	}
 
+	ignoreUnexp := cmpopts.IgnoreUnexported(Source{})
 	if !cmp.Equal(c.sources, newSources, ignoreUnexp) {
 		t.Fatalf("unexpected sources in cache: %s", cmp.Diff(c.sources, newSources, ignoreUnexp))
 	}
-	if len(c.values) != 0 {
-		t.Fatal("unexpected values in cache after new sources:", c.values)
+
+	expValues := map[int]prommodel.Vector{2: prommodel.Vector{sample}}
+	if !cmp.Equal(expValues, c.values) {
+		t.Fatal("data of an unchanged source was not kept:", cmp.Diff(expValues, c.values))
 	}
-	if c.nCache != 0 {
-		t.Fatal("cache was not flushed: ncache:", c.nCache)
+	if c.nCache != 1 {
+		t.Fatal("unexpected ncache:", c.nCache)
 	}
-	if !c.lastFlush.Equal(epoch.Time()) {
-		t.Fatal("cache flush timestamp:", c.lastFlush.Format(time.RFC3339))
+	if !c.lastFlush.Equal(lastFlush) {
+		t.Fatal("cache flush timestamp was reset:", c.lastFlush.Format(time.RFC3339))
+	}
+	if _, present := c.checkpoints[5]; present {
+		t.Fatal("checkpoint of a removed source was kept")
 	}
 
+	if c.sources[1].client != mockQueryer || !c.sources[1].nextRun.Equal(nextRun) {
+		t.Fatal("unchanged source lost its client or schedule")
+	}
 	for _, src := range c.sources {
 		if src.client == nil {
 			t.Fatal("found a source without a prometheus client:", src)
 		}
 	}
+	if c.sources[2].client != c.sources[3].client {
+		t.Fatal("src 3 and 4 have the same url but do not share the same client")
+	}
 
-	if c.sources[1].client != c.sources[2].client {
-		t.Fatal("src 1 and 2 have the same url but do not share the same client")
+	// refreshing with the same sources changes nothing
+	client := c.sources[2].client
+	flushed, changes, err = c.NewSources(newSources)
+	if err != nil {
+		t.Fatal("set same sources:", err)
+	}
+	if flushed != nil || changes.Changed() {
+		t.Fatal("unexpected flush or changes for identical sources:", flushed, changes)
+	}
+	if c.sources[2].client != client {
+		t.Fatal("client was not reused for an unchanged source")
+	}
+
+	// a modified source reuses the client for its url
+	modified := append([]Source{}, newSources...)
+	modified[2].Query = `down{job="a"}`
+	flushed, changes, err = c.NewSources(modified)
+	if err != nil {
+		t.Fatal("set modified sources:", err)
+	}
+	if flushed != nil {
+		t.Fatal("modified source data should stay in the cache, flushed:", flushed)
+	}
+	if expChanges := (SourceChanges{Modified: []int{3}}); !cmp.Equal(expChanges, changes) {
+		t.Fatal("unexpected source changes:", cmp.Diff(expChanges, changes))
+	}
+	if c.sources[2].client != client {
+		t.Fatal("client was not reused for a modified source")
 	}
 }
 
-func cacheMustEqual(t *testing.T, c1, c2 Cache) {
+func cacheMustEqual(t *testing.T, c1, c2 *Cache) {
 	t.Helper()
 
 	// The reason we have to write this custom comparer...
@@ -118,7 +182,7 @@ type cacheTestCase struct {
 	expQueryResults map[int]prommodel.Vector
 
 	// expected state of the cache after the Collect() call
-	expCache Cache
+	expCache *Cache
 }
 
 func TestCache(t *testing.T) {
@@ -154,7 +218,7 @@ func TestCache(t *testing.T) {
 				lastFlush: epoch.Time(),
 				timeLimit: 5 * time.Minute,
 			},
-			expCache: Cache{
+			expCache: &Cache{
 				limit:     1,
 				nowFn:     testNow,
 				lastFlush: epoch.Time(),
@@ -188,7 +252,7 @@ func TestCache(t *testing.T) {
 					},
 				},
 			},
-			expCache: Cache{
+			expCache: &Cache{
 				sources: []Source{
 					{
 						SourceID: 1,
@@ -241,7 +305,7 @@ func TestCache(t *testing.T) {
 				lastFlush: epoch.Time(),
 				timeLimit: 5 * time.Minute,
 			},
-			expCache: Cache{
+			expCache: &Cache{
 				sources: []Source{
 					{
 						SourceID: 1,
@@ -312,7 +376,7 @@ func TestCache(t *testing.T) {
 					},
 				},
 			},
-			expCache: Cache{
+			expCache: &Cache{
 				sources: []Source{
 					{
 						SourceID: 1,
@@ -352,7 +416,658 @@ func TestCache(t *testing.T) {
 			if !cmp.Equal(tc.expReturn, values) {
 				t.Fatal("collect: unexpected values returned:", cmp.Diff(tc.expReturn, values))
 			}
-			cacheMustEqual(t, tc.expCache, *tc.cache)
+			cacheMustEqual(t, tc.expCache, tc.cache)
+		})
+	}
+}
+
+func TestCollectFailingSource(t *testing.T) {
+	testCtx := context.WithValue(context.Background(), "MSTEST", "mstest")
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	good := prommodel.Vector{
+		&prommodel.Sample{
+			Timestamp: epoch,
+			Value:     prommodel.SampleValue(13.3),
+			Metric: prommodel.Metric{
+				"__name__": "joeblow",
+			},
+		},
+	}
+
+	failing := NewMockqueryer(ctl)
+	failing.EXPECT().Query(testCtx, "broken-query").Return(nil, errors.New("bad query"))
+	working := NewMockqueryer(ctl)
+	working.EXPECT().Query(testCtx, "a-query").Return(good, nil)
+
+	c := &Cache{
+		sources: []Source{
+			{SourceID: 1, URL: "url-1", Query: "broken-query", client: failing},
+			{SourceID: 2, URL: "url-2", Query: "a-query", client: working},
+		},
+		values:    map[int]prommodel.Vector{},
+		limit:     1,
+		nowFn:     testNow,
+		lastFlush: epoch.Time(),
+		timeLimit: 5 * time.Minute,
+	}
+
+	errorsBefore := testutil.ToFloat64(telemetry.QueryErrors.WithLabelValues("1"))
+	flushesBefore := testutil.ToFloat64(telemetry.CacheFlushes.WithLabelValues(telemetry.FlushSize))
+
+	values, err := c.Collect(testCtx)
+	collectErr, ok := err.(*CollectError)
+	if !ok {
+		t.Fatalf("expected a *CollectError, got: %#v", err)
+	}
+	if !cmp.Equal(collectErr.Failed(), []int{1}) {
+		t.Fatal("unexpected failed sources:", collectErr.Failed())
+	}
+	if collectErr.Failures[0].URL != "url-1" || collectErr.Failures[0].Query != "broken-query" {
+		t.Fatal("failure is missing source details:", collectErr.Failures[0])
+	}
+
+	expected := map[int]prommodel.Vector{2: good}
+	if !cmp.Equal(expected, values) {
+		t.Fatal("results from the working source were lost:", cmp.Diff(expected, values))
+	}
+
+	if n := testutil.ToFloat64(telemetry.QueryErrors.WithLabelValues("1")) - errorsBefore; n != 1 {
+		t.Fatal("query error was not counted:", n)
+	}
+	if n := testutil.ToFloat64(telemetry.CacheFlushes.WithLabelValues(telemetry.FlushSize)) - flushesBefore; n != 1 {
+		t.Fatal("size flush was not counted:", n)
+	}
+}
+
+type concurrencyTracker struct {
+	mu                          sync.Mutex
+	inFlight, maxInFlight       int
+	inFlightURL, maxInFlightURL map[string]int
+}
+
+type trackedQueryer struct {
+	queryer
+	tracker *concurrencyTracker
+	url     string
+	value   float64
+}
+
+func (q *trackedQueryer) Query(ctx context.Context, query string) (prommodel.Vector, error) {
+	tr := q.tracker
+
+	tr.mu.Lock()
+	tr.inFlight++
+	tr.inFlightURL[q.url]++
+	if tr.inFlight > tr.maxInFlight {
+		tr.maxInFlight = tr.inFlight
+	}
+	if tr.inFlightURL[q.url] > tr.maxInFlightURL[q.url] {
+		tr.maxInFlightURL[q.url] = tr.inFlightURL[q.url]
+	}
+	tr.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	tr.mu.Lock()
+	tr.inFlight--
+	tr.inFlightURL[q.url]--
+	tr.mu.Unlock()
+
+	return prommodel.Vector{
+		&prommodel.Sample{
+			Timestamp: epoch,
+			Value:     prommodel.SampleValue(q.value),
+			Metric: prommodel.Metric{
+				"__name__": "joeblow",
+			},
+		},
+	}, nil
+}
+
+func TestCollectConcurrency(t *testing.T) {
+	tracker := &concurrencyTracker{
+		inFlightURL:    map[string]int{},
+		maxInFlightURL: map[string]int{},
+	}
+
+	c := &Cache{
+		values:         map[int]prommodel.Vector{},
+		limit:          100,
+		nowFn:          testNow,
+		lastFlush:      epoch.Time(),
+		timeLimit:      5 * time.Minute,
+		concurrency:    3,
+		urlConcurrency: 2,
+	}
+
+	var expected prommodel.Vector
+	for i := 0; i < 8; i++ {
+		url := "url-a"
+		if i%2 == 1 {
+			url = "url-b"
+		}
+
+		c.sources = append(c.sources, Source{
+			SourceID: 1,
+			URL:      url,
+			Query:    "a-query",
+			client:   &trackedQueryer{tracker: tracker, url: url, value: float64(i)},
 		})
+		expected = append(expected, &prommodel.Sample{
+			Timestamp: epoch,
+			Value:     prommodel.SampleValue(float64(i)),
+			Metric: prommodel.Metric{
+				"__name__": "joeblow",
+			},
+		})
+	}
+
+	if _, err := c.Collect(context.Background()); err != nil {
+		t.Fatal("collect failed:", err)
+	}
+
+	if tracker.maxInFlight > 3 {
+		t.Fatal("global concurrency limit exceeded:", tracker.maxInFlight)
+	}
+	for url, n := range tracker.maxInFlightURL {
+		if n > 2 {
+			t.Fatalf("per-url concurrency limit exceeded for %s: %d", url, n)
+		}
+	}
+	if !cmp.Equal(expected, c.values[1]) {
+		t.Fatal("results were not merged in source order:", cmp.Diff(expected, c.values[1]))
+	}
+	if c.nCache != 8 {
+		t.Fatal("unexpected cache depth:", c.nCache)
+	}
+}
+
+type countingQueryer struct {
+	queryer
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (q *countingQueryer) Query(ctx context.Context, query string) (prommodel.Vector, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.calls[query]++
+	return prommodel.Vector{}, nil
+}
+
+func TestSourceIntervals(t *testing.T) {
+	now := epoch.Time()
+	q := &countingQueryer{calls: map[string]int{}}
+
+	c := &Cache{
+		sources: []Source{
+			{SourceID: 1, Query: "fast", client: q},
+			{SourceID: 2, Query: "slow", Interval: time.Minute, client: q},
+		},
+		values:          map[int]prommodel.Vector{},
+		limit:           100,
+		nowFn:           func() time.Time { return now },
+		lastFlush:       epoch.Time(),
+		timeLimit:       time.Hour,
+		defaultInterval: 5 * time.Second,
+	}
+
+	steps := []struct {
+		elapsed   time.Duration
+		fast      int
+		slow      int
+		nextRunIn time.Duration
+	}{
+		{elapsed: 0, fast: 1, slow: 1, nextRunIn: 5 * time.Second},
+		{elapsed: 5 * time.Second, fast: 2, slow: 1, nextRunIn: 10 * time.Second},
+		{elapsed: 7 * time.Second, fast: 2, slow: 1, nextRunIn: 10 * time.Second},
+		{elapsed: time.Minute, fast: 3, slow: 2, nextRunIn: time.Minute + 5*time.Second},
+	}
+
+	for _, step := range steps {
+		now = epoch.Time().Add(step.elapsed)
+
+		if _, err := c.Collect(context.Background()); err != nil {
+			t.Fatal("collect failed:", err)
+		}
+		if q.calls["fast"] != step.fast || q.calls["slow"] != step.slow {
+			t.Fatalf("at %s: unexpected query counts: %v", step.elapsed, q.calls)
+		}
+
+		next, ok := c.NextRun()
+		if !ok || !next.Equal(epoch.Time().Add(step.nextRunIn)) {
+			t.Fatalf("at %s: unexpected next run: %s", step.elapsed, next.Sub(epoch.Time()))
+		}
+	}
+}
+
+func TestNextFlush(t *testing.T) {
+	now := epoch.Time()
+	c := &Cache{
+		values:    map[int]prommodel.Vector{},
+		limit:     100,
+		nowFn:     func() time.Time { return now },
+		lastFlush: epoch.Time(),
+		timeLimit: 5 * time.Minute,
+	}
+
+	if next := c.NextFlush(); !next.Equal(epoch.Time().Add(5 * time.Minute)) {
+		t.Fatal("unexpected next flush:", next.Sub(epoch.Time()))
+	}
+
+	now = epoch.Time().Add(time.Minute)
+	c.Flush()
+	if next := c.NextFlush(); !next.Equal(epoch.Time().Add(6 * time.Minute)) {
+		t.Fatal("unexpected next flush after flushing:", next.Sub(epoch.Time()))
+	}
+}
+
+func TestSourceUnmarshalJSON(t *testing.T) {
+	input := `[
+		{"id": 1, "sourceURL": "a-url", "query": "a-query"},
+		{"id": 2, "sourceURL": "a-url", "query": "a-query", "interval": "1m"},
+		{"id": 3, "sourceURL": "a-url", "query": "a-query", "interval": 30}
+	]`
+	expected := []Source{
+		{SourceID: 1, URL: "a-url", Query: "a-query"},
+		{SourceID: 2, URL: "a-url", Query: "a-query", Interval: time.Minute},
+		{SourceID: 3, URL: "a-url", Query: "a-query", Interval: 30 * time.Second},
+	}
+
+	var sources []Source
+	if err := json.Unmarshal([]byte(input), &sources); err != nil {
+		t.Fatal("unmarshal sources:", err)
+	}
+
+	ign := cmpopts.IgnoreUnexported(Source{})
+	if !cmp.Equal(expected, sources, ign) {
+		t.Fatal("unexpected sources:", cmp.Diff(expected, sources, ign))
+	}
+
+	var bad Source
+	if err := json.Unmarshal([]byte(`{"id": 4, "interval": "soon"}`), &bad); err == nil {
+		t.Fatal("expected an error for an invalid interval")
+	}
+}
+
+func TestSourceValidate(t *testing.T) {
+	valid := Source{SourceID: 1, URL: "http://prometheus:9090", Query: "up", Mode: ModeRange, Interval: time.Minute}
+	if err := valid.Validate(); err != nil {
+		t.Fatal("unexpected error for a valid source:", err)
+	}
+
+	var cases = []struct {
+		name   string
+		modify func(*Source)
+	}{
+		{"no id", func(s *Source) { s.SourceID = 0 }},
+		{"relative url", func(s *Source) { s.URL = "prometheus:9090/api" }},
+		{"bad scheme", func(s *Source) { s.URL = "ftp://prometheus" }},
+		{"empty query", func(s *Source) { s.Query = "  " }},
+		{"scalar query", func(s *Source) { s.Query = "1" }},
+		{"unknown mode", func(s *Source) { s.Mode = "sometimes" }},
+		{"negative interval", func(s *Source) { s.Interval = -time.Second }},
+		{"negative step", func(s *Source) { s.Step = -time.Second }},
+	}
+
+	for _, tc := range cases {
+		src := valid
+		tc.modify(&src)
+		if err := src.Validate(); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+
+	// queries the parser can't check are left for the server to reject
+	unparsed := valid
+	unparsed.Query = "last_over_time(up[5m])"
+	if err := unparsed.Validate(); err != nil {
+		t.Fatal("unexpected error for a query the parser doesn't know:", err)
+	}
+}
+
+func TestRangeSource(t *testing.T) {
+	testCtx := context.WithValue(context.Background(), "MSTEST", "mstest")
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	t0 := epoch.Time()
+	now := t0
+	step := 30 * time.Second
+
+	matrix := prommodel.Matrix{
+		&prommodel.SampleStream{
+			Metric: prommodel.Metric{
+				"__name__": "joeblow",
+			},
+			Values: []prommodel.SamplePair{
+				{Timestamp: epoch, Value: prommodel.SampleValue(13.3)},
+				{Timestamp: epoch.Add(step), Value: prommodel.SampleValue(14.4)},
+			},
+		},
+	}
+	flattened := prommodel.Vector{
+		&prommodel.Sample{
+			Timestamp: epoch,
+			Value:     prommodel.SampleValue(13.3),
+			Metric: prommodel.Metric{
+				"__name__": "joeblow",
+			},
+		},
+		&prommodel.Sample{
+			Timestamp: epoch.Add(step),
+			Value:     prommodel.SampleValue(14.4),
+			Metric: prommodel.Metric{
+				"__name__": "joeblow",
+			},
+		},
+	}
+
+	mockQueryer := NewMockqueryer(ctl)
+	gomock.InOrder(
+		mockQueryer.EXPECT().QueryRange(testCtx, "a-query", t0, t0, step).Return(matrix, nil),
+		mockQueryer.EXPECT().QueryRange(testCtx, "a-query", t0.Add(step), t0.Add(time.Minute), step).Return(nil, errors.New("server down")),
+		mockQueryer.EXPECT().QueryRange(testCtx, "a-query", t0.Add(step), t0.Add(2*time.Minute), step).Return(matrix, nil),
+		mockQueryer.EXPECT().QueryRange(testCtx, "a-query", t0.Add(50*time.Minute), t0.Add(time.Hour), step).Return(matrix, nil),
+	)
+
+	c := &Cache{
+		sources: []Source{
+			{SourceID: 1, Query: "a-query", Mode: ModeRange, Step: step, Interval: time.Minute, client: mockQueryer},
+		},
+		values:      map[int]prommodel.Vector{},
+		limit:       100,
+		nowFn:       func() time.Time { return now },
+		lastFlush:   epoch.Time(),
+		timeLimit:   24 * time.Hour,
+		maxLookback: 10 * time.Minute,
+	}
+
+	steps := []struct {
+		elapsed    time.Duration
+		expectErr  bool
+		checkpoint time.Time
+	}{
+		{elapsed: 0, checkpoint: t0},
+		{elapsed: time.Minute, expectErr: true, checkpoint: t0},
+		{elapsed: 2 * time.Minute, checkpoint: t0.Add(2 * time.Minute)},
+		{elapsed: time.Hour, checkpoint: t0.Add(time.Hour)},
+	}
+
+	for _, tick := range steps {
+		now = t0.Add(tick.elapsed)
+
+		_, err := c.Collect(testCtx)
+		if (err != nil) != tick.expectErr {
+			t.Fatalf("at %s: unexpected collect result: %v", tick.elapsed, err)
+		}
+		if cp := c.Checkpoints()[1]; !cp.Equal(tick.checkpoint) {
+			t.Fatalf("at %s: unexpected checkpoint: %s", tick.elapsed, cp.Sub(t0))
+		}
+	}
+
+	expected := append(append(append(prommodel.Vector{}, flattened...), flattened...), flattened...)
+	if !cmp.Equal(expected, c.values[1]) {
+		t.Fatal("range results were not flattened into the cache:", cmp.Diff(expected, c.values[1]))
+	}
+
+	restored := &Cache{}
+	restored.RestoreCheckpoints(c.Checkpoints())
+	if !cmp.Equal(restored.Checkpoints(), c.Checkpoints()) {
+		t.Fatal("checkpoints were not restored:", cmp.Diff(restored.Checkpoints(), c.Checkpoints()))
+	}
+}
+
+func TestCollectNoData(t *testing.T) {
+	testCtx := context.WithValue(context.Background(), "MSTEST", "mstest")
+
+	for _, markers := range []bool{false, true} {
+		ctl := gomock.NewController(t)
+		mockQueryer := NewMockqueryer(ctl)
+		mockQueryer.EXPECT().Query(testCtx, "quiet-query").Return(nil, promclient.ErrNoData)
+
+		c := &Cache{
+			sources: []Source{
+				{SourceID: 1, URL: "a-url", Query: "quiet-query", client: mockQueryer},
+			},
+			values:         map[int]prommodel.Vector{},
+			limit:          10,
+			nowFn:          testNow,
+			lastFlush:      epoch.Time(),
+			timeLimit:      5 * time.Minute,
+			absenceMarkers: markers,
+		}
+
+		if _, err := c.Collect(testCtx); err != nil {
+			t.Fatal("no data should not be a collect error:", err)
+		}
+		if !cmp.Equal(c.NoData(), []int{1}) {
+			t.Fatal("no data was not recorded for the source:", c.NoData())
+		}
+
+		expected := map[int]prommodel.Vector{}
+		if markers {
+			expected[1] = prommodel.Vector{
+				&prommodel.Sample{
+					Timestamp: epoch,
+					Value:     1,
+					Metric: prommodel.Metric{
+						"__name__": AbsentMetricName,
+					},
+				},
+			}
+		}
+		if !cmp.Equal(expected, c.values) {
+			t.Fatalf("unexpected values with markers=%t: %s", markers, cmp.Diff(expected, c.values))
+		}
+
+		ctl.Finish()
+	}
+}
+
+func TestQuerySource(t *testing.T) {
+	testCtx := context.WithValue(context.Background(), "MSTEST", "mstest")
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	sample := &prommodel.Sample{Timestamp: epoch, Value: 1, Metric: prommodel.Metric{"__name__": "up"}}
+	mockQueryer := NewMockqueryer(ctl)
+	mockQueryer.EXPECT().Query(testCtx, "up").Return(prommodel.Vector{sample}, nil)
+	mockQueryer.EXPECT().QueryRange(testCtx, "rate(x[1m])", epoch.Time().Add(-time.Minute), epoch.Time(), time.Minute).
+		Return(prommodel.Matrix{{Metric: sample.Metric, Values: []prommodel.SamplePair{{Timestamp: epoch, Value: 1}}}}, nil)
+	mockQueryer.EXPECT().Query(testCtx, "quiet").Return(nil, promclient.ErrNoData)
+
+	c := &Cache{
+		sources: []Source{
+			{SourceID: 1, URL: "a-url", Query: "up", client: mockQueryer},
+			{SourceID: 2, URL: "a-url", Query: "rate(x[1m])", Mode: ModeRange, client: mockQueryer},
+			{SourceID: 3, URL: "a-url", Query: "quiet", client: mockQueryer},
+		},
+		values:          map[int]prommodel.Vector{},
+		nowFn:           testNow,
+		defaultInterval: time.Minute,
+	}
+
+	for _, id := range []int{1, 2} {
+		vector, err := c.QuerySource(testCtx, id)
+		if err != nil {
+			t.Fatalf("query source %d: %v", id, err)
+		}
+		if !cmp.Equal(prommodel.Vector{sample}, vector) {
+			t.Fatalf("unexpected result for source %d: %s", id, cmp.Diff(prommodel.Vector{sample}, vector))
+		}
+	}
+
+	if _, err := c.QuerySource(testCtx, 3); errors.Cause(err) != promclient.ErrNoData {
+		t.Fatal("expected no data, got:", err)
+	}
+	if _, err := c.QuerySource(testCtx, 4); err == nil {
+		t.Fatal("expected an error for an unknown source")
+	}
+	if len(c.values) != 0 {
+		t.Fatal("one-off queries should not be cached:", c.values)
+	}
+}
+
+func TestConnectionFor(t *testing.T) {
+	c := &Cache{
+		connections: map[string]Connection{
+			"thanos":      {URL: "https://thanos.example.com/"},
+			"thanos-team": {URL: "https://thanos.example.com/team/"},
+			"mimir":       {},
+		},
+	}
+
+	var cases = []struct {
+		src      Source
+		expected string
+		err      bool
+	}{
+		{src: Source{URL: "http://localhost:9090"}, expected: ""},
+		{src: Source{URL: "https://thanos.example.com/"}, expected: "thanos"},
+		{src: Source{URL: "https://thanos.example.com/team/prom"}, expected: "thanos-team"},
+		{src: Source{URL: "https://thanos.example.com/", Connection: "mimir"}, expected: "mimir"},
+		{src: Source{URL: "https://thanos.example.com/", Connection: "nope"}, err: true},
+	}
+
+	for _, tc := range cases {
+		profile, err := c.connectionFor(tc.src)
+		if (err != nil) != tc.err {
+			t.Fatalf("%+v: unexpected error: %v", tc.src, err)
+		}
+		if profile != tc.expected {
+			t.Fatalf("%+v: profile got: %q expected: %q", tc.src, profile, tc.expected)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	values := map[int]prommodel.Vector{
+		1: prommodel.Vector{
+			&prommodel.Sample{
+				Timestamp: epoch,
+				Value:     prommodel.SampleValue(13.3),
+				Metric: prommodel.Metric{
+					"__name__": "joeblow",
+				},
+			},
+		},
+	}
+
+	c := &Cache{
+		values:    values,
+		nCache:    1,
+		limit:     10,
+		nowFn:     testNowElapsed,
+		lastFlush: epoch.Time(),
+		timeLimit: time.Hour,
+	}
+
+	flushed := c.Flush()
+	if !cmp.Equal(values, flushed) {
+		t.Fatal("unexpected flushed values:", cmp.Diff(values, flushed))
+	}
+
+	cacheMustEqual(t, &Cache{
+		values:    map[int]prommodel.Vector{},
+		limit:     10,
+		lastFlush: testNowElapsed(),
+	}, c)
+}
+
+// sampleQueryer returns one sample per query, and is safe for concurrent use.
+type sampleQueryer struct {
+	queryer
+}
+
+func (sampleQueryer) Query(ctx context.Context, query string) (prommodel.Vector, error) {
+	return prommodel.Vector{
+		&prommodel.Sample{
+			Timestamp: epoch,
+			Value:     prommodel.SampleValue(1),
+			Metric: prommodel.Metric{
+				"__name__": prommodel.LabelValue(query),
+			},
+		},
+	}, nil
+}
+
+// TestConcurrentUse is meant to be run with the race detector.
+func TestConcurrentUse(t *testing.T) {
+	kept := Source{SourceID: 1, Query: "kept", client: sampleQueryer{}}
+	// the added source can't be reached, its queries fail right away
+	added := Source{SourceID: 2, URL: "http://127.0.0.1:0", Query: "added"}
+
+	c := &Cache{
+		sources:     []Source{kept},
+		values:      map[int]prommodel.Vector{},
+		limit:       5,
+		timeLimit:   time.Hour,
+		nowFn:       time.Now,
+		lastFlush:   time.Now(),
+		checkpoints: map[int]time.Time{},
+	}
+
+	var mu sync.Mutex
+	collected := 0
+	count := func(data map[int]prommodel.Vector) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, vector := range data {
+			collected += len(vector)
+		}
+	}
+
+	const iterations = 50
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	run(func(int) {
+		data, _ := c.Collect(context.Background())
+		count(data)
+	})
+	run(func(int) {
+		data, _ := c.Collect(context.Background())
+		count(data)
+	})
+	run(func(i int) {
+		sources := []Source{{SourceID: 1, Query: "kept"}}
+		if i%2 == 0 {
+			sources = append(sources, added)
+		}
+		data, _, err := c.NewSources(sources)
+		if err != nil {
+			t.Error("new sources:", err)
+		}
+		count(data)
+	})
+	run(func(int) {
+		count(c.Flush())
+	})
+	run(func(int) {
+		c.Stats()
+		c.NextRun()
+		c.NoData()
+		c.RestoreCheckpoints(c.Checkpoints())
+	})
+	wg.Wait()
+
+	count(c.Flush())
+	if stats := c.Stats(); stats.Samples != 0 {
+		t.Fatal("samples left in the cache after a flush:", stats.Samples)
+	}
+	if collected == 0 {
+		t.Fatal("nothing was collected")
 	}
 }
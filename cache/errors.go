@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SourceError describes a failed query against a single source.
+type SourceError struct {
+	SourceID int
+	URL      string
+	Query    string
+	Err      error
+	// Quarantined is set if the source was taken out of the schedule
+	// because of the error.
+	Quarantined bool
+}
+
+func (e *SourceError) Error() string {
+	msg := fmt.Sprintf("source %d (url: %s query: %s): %v", e.SourceID, e.URL, e.Query, e.Err)
+	if e.Quarantined {
+		msg += ", quarantined until its query changes"
+	}
+	return msg
+}
+
+// Cause returns the underlying query error.
+func (e *SourceError) Cause() error {
+	return e.Err
+}
+
+// CollectError is returned by Collect when one or more sources failed. Data
+// from the sources that succeeded is still collected.
+type CollectError struct {
+	Failures []*SourceError
+	// NSources is the number of sources that were queried.
+	NSources int
+}
+
+func (e *CollectError) Error() string {
+	msgs := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		msgs = append(msgs, f.Error())
+	}
+
+	return fmt.Sprintf("%d of %d sources failed: %s", len(e.Failures), e.NSources, strings.Join(msgs, "; "))
+}
+
+// Failed returns the IDs of the sources that failed.
+func (e *CollectError) Failed() []int {
+	ids := make([]int, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		ids = append(ids, f.SourceID)
+	}
+
+	return ids
+}
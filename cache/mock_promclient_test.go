@@ -9,6 +9,7 @@ import (
 	gomock "github.com/golang/mock/gomock"
 	model "github.com/prometheus/common/model"
 	reflect "reflect"
+	time "time"
 )
 
 // Mockqueryer is a mock of queryer interface
@@ -48,3 +49,18 @@ func (mr *MockqueryerMockRecorder) Query(ctx, query interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Query", reflect.TypeOf((*Mockqueryer)(nil).Query), ctx, query)
 }
+
+// QueryRange mocks base method
+func (m *Mockqueryer) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) (model.Matrix, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "QueryRange", ctx, query, start, end, step)
+	ret0, _ := ret[0].(model.Matrix)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// QueryRange indicates an expected call of QueryRange
+func (mr *MockqueryerMockRecorder) QueryRange(ctx, query, start, end, step interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueryRange", reflect.TypeOf((*Mockqueryer)(nil).QueryRange), ctx, query, start, end, step)
+}
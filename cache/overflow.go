@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/MindsightCo/collector/telemetry"
+	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// Overflow policies, applied when adding samples would take the cache past
+// its sample cap.
+const (
+	// OverflowDropOldest discards the oldest samples in the cache.
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDropNewest discards the samples that don't fit.
+	OverflowDropNewest = "drop_newest"
+	// OverflowDownsample discards every other sample of each series until
+	// the new samples fit, dropping the oldest samples if that's not enough.
+	OverflowDownsample = "downsample"
+	// OverflowSpill flushes the cache early, so the caller can write the
+	// data out (e.g. to the spool) instead of holding it in memory.
+	OverflowSpill = "spill"
+)
+
+// WithMaxSamples caps the number of samples held in the cache, whatever its
+// flush size, applying policy when the cap is reached. Zero means no cap.
+func WithMaxSamples(max int, policy string) Option {
+	return func(c *Cache) {
+		c.maxSamples = max
+		c.overflowPolicy = policy
+	}
+}
+
+// ValidOverflowPolicy returns an error if policy isn't one of the overflow
+// policies, or empty for the default.
+func ValidOverflowPolicy(policy string) error {
+	switch policy {
+	case "", OverflowDropOldest, OverflowDropNewest, OverflowDownsample, OverflowSpill:
+		return nil
+	}
+
+	return errors.Errorf("unknown overflow policy: %q", policy)
+}
+
+// add puts vector in the cache under id, applying the overflow policy if
+// needed. With OverflowSpill, the data flushed to make room is returned.
+func (c *Cache) add(id int, vector prommodel.Vector) map[int]prommodel.Vector {
+	var spilled map[int]prommodel.Vector
+
+	if c.maxSamples > 0 && c.nCache+len(vector) > c.maxSamples {
+		switch c.overflowPolicy {
+		case OverflowSpill:
+			telemetry.CacheFlushes.WithLabelValues(telemetry.FlushOverflow).Inc()
+			spilled = c.values
+			c.values = make(map[int]prommodel.Vector)
+			c.nCache = 0
+			c.lastFlush = c.nowFn()
+
+		case OverflowDropNewest:
+			room := c.maxSamples - c.nCache
+			if room < 0 {
+				room = 0
+			}
+			c.countDropped(id, len(vector)-room)
+			vector = vector[:room]
+		}
+	}
+
+	if len(vector) > 0 {
+		c.values[id] = append(c.values[id], vector...)
+		c.nCache += len(vector)
+	}
+
+	if c.maxSamples > 0 && c.nCache > c.maxSamples {
+		if c.overflowPolicy == OverflowDownsample {
+			c.downsample()
+		}
+		// also covers a single vector larger than the cap, whatever the
+		// policy
+		if c.nCache > c.maxSamples {
+			c.dropOldest(c.nCache - c.maxSamples)
+		}
+	}
+
+	return spilled
+}
+
+func (c *Cache) countDropped(id, n int) {
+	if n <= 0 {
+		return
+	}
+
+	if c.dropped == nil {
+		c.dropped = make(map[int]int)
+	}
+	c.dropped[id] += n
+	telemetry.SamplesDropped.WithLabelValues(strconv.Itoa(id)).Add(float64(n))
+}
+
+// sampleRef locates a sample in the cache.
+type sampleRef struct {
+	id, idx   int
+	timestamp prommodel.Time
+}
+
+// dropOldest removes the n samples with the oldest timestamps.
+func (c *Cache) dropOldest(n int) {
+	var refs []sampleRef
+	for id, vector := range c.values {
+		for idx, sample := range vector {
+			refs = append(refs, sampleRef{id: id, idx: idx, timestamp: sample.Timestamp})
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].timestamp != refs[j].timestamp {
+			return refs[i].timestamp < refs[j].timestamp
+		}
+		if refs[i].id != refs[j].id {
+			return refs[i].id < refs[j].id
+		}
+		return refs[i].idx < refs[j].idx
+	})
+	if n > len(refs) {
+		n = len(refs)
+	}
+
+	drop := make(map[int]map[int]bool)
+	for _, ref := range refs[:n] {
+		if drop[ref.id] == nil {
+			drop[ref.id] = make(map[int]bool)
+		}
+		drop[ref.id][ref.idx] = true
+	}
+
+	for id, indexes := range drop {
+		c.removeSamples(id, indexes)
+	}
+}
+
+// downsample halves the resolution of every series in the cache until the
+// cache is within its cap, or can't be thinned any more. The newest sample of
+// each series is always kept.
+func (c *Cache) downsample() {
+	for c.nCache > c.maxSamples {
+		before := c.nCache
+
+		for id, vector := range c.values {
+			// position of each sample within its series, counting from the
+			// newest
+			seen := make(map[prommodel.Fingerprint]int)
+			indexes := make(map[int]bool)
+			for idx := len(vector) - 1; idx >= 0; idx-- {
+				fp := vector[idx].Metric.Fingerprint()
+				if seen[fp]%2 == 1 {
+					indexes[idx] = true
+				}
+				seen[fp]++
+			}
+
+			c.removeSamples(id, indexes)
+		}
+
+		if c.nCache == before {
+			return
+		}
+	}
+}
+
+// removeSamples drops the samples at the given indexes of a source's vector.
+func (c *Cache) removeSamples(id int, indexes map[int]bool) {
+	if len(indexes) == 0 {
+		return
+	}
+
+	var kept prommodel.Vector
+	for idx, sample := range c.values[id] {
+		if !indexes[idx] {
+			kept = append(kept, sample)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(c.values, id)
+	} else {
+		c.values[id] = kept
+	}
+
+	c.nCache -= len(indexes)
+	c.countDropped(id, len(indexes))
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	prommodel "github.com/prometheus/common/model"
+)
+
+func testSample(name string, ts int64) *prommodel.Sample {
+	return &prommodel.Sample{
+		Timestamp: prommodel.TimeFromUnix(ts),
+		Value:     prommodel.SampleValue(ts),
+		Metric: prommodel.Metric{
+			"__name__": prommodel.LabelValue(name),
+		},
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	var cases = []struct {
+		policy     string
+		expValues  map[int]prommodel.Vector
+		expSpilled map[int]prommodel.Vector
+		expDropped map[int]int
+	}{
+		{
+			policy: OverflowDropOldest,
+			expValues: map[int]prommodel.Vector{
+				1: {testSample("a", 2), testSample("a", 3)},
+				2: {testSample("b", 4), testSample("b", 5)},
+			},
+			expDropped: map[int]int{1: 1},
+		},
+		{
+			policy: OverflowDropNewest,
+			expValues: map[int]prommodel.Vector{
+				1: {testSample("a", 1), testSample("a", 2), testSample("a", 3)},
+				2: {testSample("b", 4)},
+			},
+			expDropped: map[int]int{2: 1},
+		},
+		{
+			policy: OverflowDownsample,
+			expValues: map[int]prommodel.Vector{
+				1: {testSample("a", 1), testSample("a", 3)},
+				2: {testSample("b", 5)},
+			},
+			expDropped: map[int]int{1: 1, 2: 1},
+		},
+		{
+			policy: OverflowSpill,
+			expValues: map[int]prommodel.Vector{
+				2: {testSample("b", 4), testSample("b", 5)},
+			},
+			expSpilled: map[int]prommodel.Vector{
+				1: {testSample("a", 1), testSample("a", 2), testSample("a", 3)},
+			},
+			expDropped: map[int]int{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.policy, func(t *testing.T) {
+			c := &Cache{
+				values: map[int]prommodel.Vector{
+					1: {testSample("a", 1), testSample("a", 2), testSample("a", 3)},
+				},
+				nCache:         3,
+				nowFn:          testNow,
+				maxSamples:     4,
+				overflowPolicy: tc.policy,
+			}
+
+			spilled := c.add(2, prommodel.Vector{testSample("b", 4), testSample("b", 5)})
+
+			if !cmp.Equal(tc.expValues, c.values) {
+				t.Fatal("unexpected cache values:", cmp.Diff(tc.expValues, c.values))
+			}
+			if !cmp.Equal(tc.expSpilled, spilled) {
+				t.Fatal("unexpected spilled values:", cmp.Diff(tc.expSpilled, spilled))
+			}
+			if stats := c.Stats(); !cmp.Equal(tc.expDropped, stats.Dropped) {
+				t.Fatal("unexpected dropped counts:", cmp.Diff(tc.expDropped, stats.Dropped))
+			}
+
+			n := 0
+			for _, vector := range c.values {
+				n += len(vector)
+			}
+			if n != c.nCache || n > c.maxSamples {
+				t.Fatalf("cache holds %d samples, ncache: %d, cap: %d", n, c.nCache, c.maxSamples)
+			}
+		})
+	}
+}
+
+func TestInvalidOverflowPolicy(t *testing.T) {
+	if _, err := NewCache(nil, 10, time.Minute, WithMaxSamples(10, "panic")); err == nil {
+		t.Fatal("expected an error for an unknown overflow policy")
+	}
+}
@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// maxQueryRange is the longest range selector or subquery that isn't flagged
+// as expensive. Sources are queried every few seconds to minutes, so anything
+// longer makes the prometheus server read a lot of data over and over.
+const maxQueryRange = time.Hour * 24
+
+// functions whose result is a single series, like an aggregation's
+var aggregatingFuncs = map[string]bool{
+	"absent": true,
+	"scalar": true,
+}
+
+// parseError is returned by CheckQuery for a query it can't parse.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "parse query: " + e.err.Error()
+}
+
+// IsParseError reports whether CheckQuery returned err because it couldn't
+// parse the query. The parser predates many PromQL functions and syntax, such
+// as last_over_time or the @ modifier, so such a query may still be valid for
+// its server.
+func IsParseError(err error) bool {
+	_, ok := errors.Cause(err).(*parseError)
+	return ok
+}
+
+// CheckQuery parses a source's PromQL query. It returns an error if the query
+// can't be parsed (see IsParseError) or doesn't return an instant vector, and
+// otherwise warnings about patterns that are expensive for the prometheus
+// server: unbounded regex matchers, very large ranges, and selectors of many
+// series that aren't aggregated.
+func CheckQuery(query string) ([]string, error) {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return nil, &parseError{err: err}
+	}
+	if expr.Type() != promql.ValueTypeVector {
+		return nil, errors.Errorf("query must return an instant vector, got: %s", expr.Type())
+	}
+
+	var warnings []string
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	promql.Inspect(expr, func(node promql.Node, path []promql.Node) error {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			checkMatchers(n.String(), n.LabelMatchers, warn)
+			if !aggregated(path) {
+				checkCardinality(n.Name, n.LabelMatchers, warn)
+			}
+
+		case *promql.MatrixSelector:
+			checkMatchers(n.String(), n.LabelMatchers, warn)
+			if !aggregated(path) {
+				checkCardinality(n.Name, n.LabelMatchers, warn)
+			}
+			if n.Range > maxQueryRange {
+				warn("range selector %s covers more than %s", n, maxQueryRange)
+			}
+
+		case *promql.SubqueryExpr:
+			if n.Range > maxQueryRange {
+				warn("subquery %s covers more than %s", n, maxQueryRange)
+			}
+		}
+		return nil
+	})
+
+	return warnings, nil
+}
+
+// checkMatchers flags regex matchers with a leading wildcard, which can't
+// narrow down the series to read, and selectors that only have such matchers.
+func checkMatchers(selector string, matchers []*labels.Matcher, warn func(string, ...interface{})) {
+	bounded := false
+	for _, m := range matchers {
+		switch m.Type {
+		case labels.MatchEqual:
+			if m.Value != "" {
+				bounded = true
+			}
+		case labels.MatchRegexp:
+			if strings.HasPrefix(m.Value, ".*") || strings.HasPrefix(m.Value, ".+") {
+				warn("regex matcher %s in %s starts with a wildcard, every value of the label is scanned", m, selector)
+			} else {
+				bounded = true
+			}
+		}
+	}
+
+	if !bounded {
+		warn("selector %s has no metric name or bounded matcher, it scans every series", selector)
+	}
+}
+
+// checkCardinality flags unaggregated selectors likely to return many series:
+// those that only select a metric by name, and histogram buckets.
+func checkCardinality(name string, matchers []*labels.Matcher, warn func(string, ...interface{})) {
+	if name == "" {
+		return
+	}
+
+	filtered := false
+	for _, m := range matchers {
+		if m.Name != labels.MetricName {
+			filtered = true
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(name, "_bucket"):
+		warn("histogram buckets of %s aren't aggregated, every bucket of every series is pushed", name)
+	case !filtered:
+		warn("every series of %s is selected without aggregation, filter it by label or aggregate it", name)
+	}
+}
+
+// aggregated tells whether any node of path reduces its input to a few series.
+func aggregated(path []promql.Node) bool {
+	for _, node := range path {
+		switch n := node.(type) {
+		case *promql.AggregateExpr:
+			return true
+		case *promql.Call:
+			if aggregatingFuncs[n.Func.Name] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// quarantinedSource is a source whose query was rejected, by CheckQuery or,
+// if confirmed, by its server.
+type quarantinedSource struct {
+	query     string
+	err       error
+	confirmed bool
+}
+
+// queryCheck is the outcome of checkQueries.
+type queryCheck struct {
+	// valid are the sources to schedule
+	valid []Source
+	// quarantine holds the sources kept out of the schedule, by SourceID
+	quarantine map[int]quarantinedSource
+	// unverified holds the queries of valid sources that couldn't be parsed,
+	// by SourceID
+	unverified map[int]string
+	// warnings about valid sources, by SourceID
+	warnings map[int][]string
+}
+
+// checkQueries runs CheckQuery on the query of every source. Sources whose
+// query doesn't return an instant vector are quarantined. Queries that can't
+// be parsed are left for their server to check, unless it already rejected
+// them: prev is the current quarantine.
+func checkQueries(sources []Source, prev map[int]quarantinedSource) queryCheck {
+	check := queryCheck{
+		quarantine: make(map[int]quarantinedSource),
+		unverified: make(map[int]string),
+		warnings:   make(map[int][]string),
+	}
+
+	for _, src := range sources {
+		srcWarnings, err := CheckQuery(src.Query)
+		if IsParseError(err) {
+			if q, present := prev[src.SourceID]; present && q.query == src.Query && q.confirmed {
+				check.quarantine[src.SourceID] = q
+				continue
+			}
+
+			check.unverified[src.SourceID] = src.Query
+			srcWarnings = []string{fmt.Sprintf("query left for the server to check: %v", err)}
+		} else if err != nil {
+			check.quarantine[src.SourceID] = quarantinedSource{query: src.Query, err: err}
+			continue
+		}
+
+		check.valid = append(check.valid, src)
+		check.warnings[src.SourceID] = append(check.warnings[src.SourceID], srcWarnings...)
+	}
+
+	return check
+}
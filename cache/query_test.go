@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	promclient "github.com/MindsightCo/collector/prometheus_client"
+	gomock "github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	prometheus "github.com/prometheus/client_golang/api/prometheus/v1"
+	prommodel "github.com/prometheus/common/model"
+)
+
+func TestCheckQuery(t *testing.T) {
+	var cases = []struct {
+		query       string
+		expInvalid  bool
+		expParseErr bool
+		expWarnings []string
+	}{
+		{query: `up{job="a"}`},
+		{query: `sum(rate(http_requests_total[5m])) by (job)`},
+		{query: `sum(rate(latency_bucket[5m])) by (le)`},
+		{query: `absent(up)`},
+		{query: `sum(`, expInvalid: true, expParseErr: true},
+		// newer than the parser, left for the server to check
+		{query: `group(up)`, expInvalid: true, expParseErr: true},
+		{query: `last_over_time(up{job="a"}[5m])`, expInvalid: true, expParseErr: true},
+		{query: `clamp(up{job="a"}, 0, 1)`, expInvalid: true, expParseErr: true},
+		{query: `absent_over_time(up{job="a"}[5m])`, expInvalid: true, expParseErr: true},
+		{query: `present_over_time(up{job="a"}[5m])`, expInvalid: true, expParseErr: true},
+		{query: `up{job="a"} @ end()`, expInvalid: true, expParseErr: true},
+		{query: `up{job="a"}[5m]`, expInvalid: true},
+		{query: `1`, expInvalid: true},
+		{
+			query:       `up`,
+			expWarnings: []string{"every series of up is selected without aggregation, filter it by label or aggregate it"},
+		},
+		{
+			query:       `histogram_quantile(0.9, rate(latency_bucket{job="a"}[5m]))`,
+			expWarnings: []string{"histogram buckets of latency_bucket aren't aggregated, every bucket of every series is pushed"},
+		},
+		{
+			query: `count({job=~".+"})`,
+			expWarnings: []string{
+				`regex matcher job=~".+" in {job=~".+"} starts with a wildcard, every value of the label is scanned`,
+				`selector {job=~".+"} has no metric name or bounded matcher, it scans every series`,
+			},
+		},
+		{
+			query:       `sum(rate(errors{job="a"}[2d]))`,
+			expWarnings: []string{`range selector errors{job="a"}[2d] covers more than 24h0m0s`},
+		},
+		{
+			query:       `max_over_time(up{job="a"}[30d:1m])`,
+			expWarnings: []string{`subquery up{job="a"}[30d:1m] covers more than 24h0m0s`},
+		},
+	}
+
+	for _, tc := range cases {
+		warnings, err := CheckQuery(tc.query)
+		if tc.expInvalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.query)
+			} else if IsParseError(err) != tc.expParseErr {
+				t.Errorf("%s: parse error got: %t expected: %t (%v)", tc.query, IsParseError(err), tc.expParseErr, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.query, err)
+		}
+		if !cmp.Equal(tc.expWarnings, warnings) {
+			t.Errorf("%s: unexpected warnings: %s", tc.query, cmp.Diff(tc.expWarnings, warnings))
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	testCtx := context.WithValue(context.Background(), "MSTEST", "mstest")
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	sample := &prommodel.Sample{Timestamp: epoch, Value: 1, Metric: prommodel.Metric{"__name__": "up"}}
+
+	c, err := NewCache(nil, 10, time.Minute)
+	if err != nil {
+		t.Fatal("new cache:", err)
+	}
+	c.nowFn = testNow
+	c.values[4] = prommodel.Vector{sample}
+	c.nCache = 1
+
+	sources := []Source{
+		{SourceID: 1, URL: "http://prometheus", Query: `up{job="a"}`},
+		{SourceID: 2, URL: "http://prometheus", Query: `sum(`},
+		{SourceID: 3, URL: "http://prometheus", Query: `up`},
+		{SourceID: 4, URL: "http://prometheus", Query: `up{job="a"}[5m]`},
+		{SourceID: 5, URL: "http://prometheus", Query: `last_over_time(up{job="a"}[5m])`},
+	}
+	flushed, changes, err := c.NewSources(sources)
+	if err != nil {
+		t.Fatal("new sources:", err)
+	}
+
+	// only the query that doesn't return an instant vector is quarantined,
+	// those the parser can't parse are left for the server to check
+	if ids := scheduled(c); !cmp.Equal([]int{1, 2, 3, 5}, ids) {
+		t.Fatal("unexpected scheduled sources:", ids)
+	}
+	if _, present := changes.Quarantined[4]; !present || len(changes.Quarantined) != 1 {
+		t.Fatal("unexpected quarantined sources:", changes.Quarantined)
+	}
+	if !cmp.Equal([]int{1, 2, 3, 5}, changes.Added) {
+		t.Fatal("unexpected added sources:", changes.Added)
+	}
+	if len(changes.Warnings) != 3 || len(changes.Warnings[2]) != 1 || len(changes.Warnings[3]) != 1 || len(changes.Warnings[5]) != 1 {
+		t.Fatal("unexpected warnings:", changes.Warnings)
+	}
+	if !cmp.Equal(map[int]prommodel.Vector{4: {sample}}, flushed) {
+		t.Fatal("data of the quarantined source was not flushed:", flushed)
+	}
+
+	if _, err := c.QuerySource(testCtx, 4); err == nil || errors.Cause(err) == promclient.ErrNoData {
+		t.Fatal("expected an error querying a quarantined source, got:", err)
+	}
+
+	// the server rejects the query of source 2 as invalid, and source 5's
+	// server is only failing
+	badQuery := errors.Wrap(&prometheus.Error{Type: prometheus.ErrBadData, Msg: "parse error"}, "execute prometheus query")
+	serverDown := errors.Wrap(&prometheus.Error{Type: prometheus.ErrServer, Msg: "server error: 503"}, "execute prometheus query")
+	for idx, src := range c.sources {
+		q := NewMockqueryer(ctl)
+		switch src.SourceID {
+		case 2:
+			q.EXPECT().Query(testCtx, src.Query).Return(nil, badQuery)
+		case 5:
+			q.EXPECT().Query(testCtx, src.Query).Return(nil, serverDown).Times(2)
+		default:
+			q.EXPECT().Query(testCtx, src.Query).Return(prommodel.Vector{sample}, nil).Times(2)
+		}
+		c.sources[idx].client = q
+	}
+
+	_, err = c.Collect(testCtx)
+	collectErr, ok := err.(*CollectError)
+	if !ok || !cmp.Equal([]int{2, 5}, collectErr.Failed()) {
+		t.Fatal("unexpected collect error:", err)
+	}
+	if !collectErr.Failures[0].Quarantined || collectErr.Failures[1].Quarantined {
+		t.Fatal("only the source rejected by its server should be quarantined:", collectErr)
+	}
+	if ids := scheduled(c); !cmp.Equal([]int{1, 3, 5}, ids) {
+		t.Fatal("unexpected scheduled sources after collect:", ids)
+	}
+
+	// a source still quarantined isn't reported again, nor are warnings for
+	// unchanged sources
+	_, changes, err = c.NewSources(sources)
+	if err != nil {
+		t.Fatal("set same sources:", err)
+	}
+	if changes.Changed() || changes.Warnings != nil {
+		t.Fatal("unexpected changes for identical sources:", changes, changes.Warnings)
+	}
+	if ids := scheduled(c); !cmp.Equal([]int{1, 3, 5}, ids) {
+		t.Fatal("source rejected by its server was scheduled again:", ids)
+	}
+	c.nowFn = testNowElapsed
+	if _, err := c.Collect(testCtx); err == nil {
+		t.Fatal("expected source 5 to fail again")
+	}
+
+	// fixing the queries takes the sources out of quarantine
+	sources[1].Query = `up{job="b"}`
+	sources[3].Query = `up{job="c"}`
+	_, changes, err = c.NewSources(sources)
+	if err != nil {
+		t.Fatal("set fixed sources:", err)
+	}
+	if !cmp.Equal([]int{2, 4}, changes.Added) || len(c.sources) != 5 || len(c.quarantine) != 0 {
+		t.Fatal("fixed sources were not scheduled:", changes, scheduled(c))
+	}
+}
+
+// scheduled returns the IDs of the cache's sources.
+func scheduled(c *Cache) []int {
+	var ids []int
+	for _, src := range c.sources {
+		ids = append(ids, src.SourceID)
+	}
+	return ids
+}
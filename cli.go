@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// version is set at build time, with -ldflags "-X main.version=..."
+var version = "dev"
+
+func newRootCmd() *cobra.Command {
+	var configFile string
+
+	root := &cobra.Command{
+		Use:   "collector",
+		Short: "Collects metrics from prometheus servers and pushes them to Mindsight",
+		Long: `Collects metrics from prometheus servers and pushes them to Mindsight.
+
+Without a command, the collector runs. Flags override the config file and
+the environment.`,
+		Args: cobra.NoArgs,
+		// errors are logged by main, and usage isn't helpful for most of them
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if configFile == "" {
+				return nil
+			}
+			if _, err := os.Stat(configFile); err != nil {
+				return errors.Wrap(err, "config file")
+			}
+			viper.SetConfigFile(configFile)
+			return nil
+		},
+		RunE: runAgent,
+	}
+
+	flags := root.PersistentFlags()
+	flags.StringVar(&configFile, "config", "", "config file (default: mindsight-agent.yaml in . or /etc/mindsight/)")
+	addConfigFlags(flags)
+
+	sources := &cobra.Command{
+		Use:   "sources",
+		Short: "Inspect metric sources",
+	}
+	sources.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the sources the collector would run, from the config and the API",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listSources(context.Background(), os.Stdout)
+		},
+	})
+
+	root.AddCommand(
+		&cobra.Command{
+			Use:   "run",
+			Short: "Run the collector (the default)",
+			Args:  cobra.NoArgs,
+			RunE:  runAgent,
+		},
+		&cobra.Command{
+			Use:   "validate",
+			Short: "Check the config, credentials and every source, then exit",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if !validate(context.Background(), os.Stdout) {
+					return errors.New("validation failed")
+				}
+				return nil
+			},
+		},
+		sources,
+		&cobra.Command{
+			Use:   "query <source-id>",
+			Short: "Run a source's query once and print the result",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				id, err := strconv.Atoi(args[0])
+				if err != nil {
+					return errors.Errorf("invalid source id: %q", args[0])
+				}
+				return querySource(context.Background(), os.Stdout, id)
+			},
+		},
+		&cobra.Command{
+			Use:   "push-file <path>",
+			Short: "Push the batches saved by a file sink (- for standard input) to the configured sinks",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return pushFile(context.Background(), args[0])
+			},
+		},
+		&cobra.Command{
+			Use:   "version",
+			Short: "Print the collector's version",
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				fmt.Printf("collector %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+			},
+		},
+	)
+
+	return root
+}
+
+// addConfigFlags adds flags for the config keys most often changed on-box,
+// and binds each to its key: a flag that is given overrides the config file
+// and the environment.
+func addConfigFlags(flags *pflag.FlagSet) {
+	flags.String("api-server", "", "Mindsight API server")
+	flags.String("client-id", "", "Mindsight API client ID")
+	flags.String("source-mode", "", "where sources come from: api, local or merged")
+	flags.String("sources-dir", "", "directory of source files")
+	flags.Duration("scrape-interval", 0, "default interval between source queries")
+	flags.Duration("refresh-sources-interval", 0, "interval between polls of the API for sources")
+	flags.Duration("query-timeout", 0, "timeout of each source query")
+	flags.Duration("cache-age", 0, "flush the cache when it's this old")
+	flags.Int("cache-depth", 0, "flush the cache when it holds this many samples")
+	flags.String("spool-dir", "", "directory where unpushed batches are spooled")
+	flags.String("state-dir", "", "directory where state is kept across restarts")
+	flags.String("listen-address", "", "address serving the collector's metrics and health checks")
+	flags.String("push-format", "", "format of pushed batches")
+	flags.Bool("dry-run", false, "print batches instead of pushing them, and leave nothing on disk")
+
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		viper.BindPFlag(strings.Replace(f.Name, "-", "_", -1), f)
+	})
+}
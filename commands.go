@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MindsightCo/collector/cache"
+	promclient "github.com/MindsightCo/collector/prometheus_client"
+	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// probeTimeout bounds each one-off source query when the config doesn't set
+// a query timeout.
+const probeTimeout = time.Second * 10
+
+// loadSources returns the sources the collector would run right now, getting
+// them from the API unless they only come from the configuration.
+func (c *Config) loadSources(ctx context.Context) ([]cache.Source, error) {
+	if c.SourceMode == sourceModeLocal {
+		return c.combineSources(nil), nil
+	}
+
+	if err := c.initAuth(true); err != nil {
+		return nil, errors.Wrap(err, "init auth")
+	}
+	apiSources, err := c.fetchSources(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "query sources")
+	}
+
+	return c.combineSources(apiSources), nil
+}
+
+// newProbeCache returns a cache holding sources, for running their queries
+// one at a time with QuerySource. It takes the collector's cache settings, so
+// that settings the collector would refuse are refused here too.
+func (c *Config) newProbeCache(sources []cache.Source) (*cache.Cache, error) {
+	timeout := c.QueryTimeout
+	if timeout <= 0 {
+		timeout = probeTimeout
+	}
+
+	return cache.NewCache(sources, c.CacheDepth, c.CacheAge,
+		cache.WithConnections(c.Connections),
+		cache.WithDefaultInterval(c.ScrapeInterval),
+		cache.WithQueryTimeout(timeout),
+		cache.WithMaxSamples(c.CacheMaxSamples, c.CacheOverflowPolicy))
+}
+
+// sourceOrigin tells whether src, as returned by combineSources, is defined
+// locally or by the API.
+func (c *Config) sourceOrigin(src cache.Source) string {
+	if c.SourceMode == sourceModeAPI {
+		return "api"
+	}
+
+	for _, local := range c.Sources {
+		if local == src {
+			return "local"
+		}
+	}
+	return "api"
+}
+
+// listSources prints the sources the collector would run.
+func listSources(ctx context.Context, out io.Writer) error {
+	c, err := readConfigNoPush()
+	if err != nil {
+		return errors.Wrap(err, "error verifying config")
+	}
+
+	sources, err := c.loadSources(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tORIGIN\tMODE\tINTERVAL\tURL\tQUERY")
+	for _, src := range sources {
+		mode := src.Mode
+		if mode == "" {
+			mode = cache.ModeInstant
+		}
+		interval := src.Interval.String()
+		if src.Interval == 0 {
+			interval = c.ScrapeInterval.String() + " (default)"
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", src.SourceID, c.sourceOrigin(src), mode, interval, src.URL, src.Query)
+	}
+
+	return tw.Flush()
+}
+
+// querySource runs the query of one source and prints the samples it returns.
+func querySource(ctx context.Context, out io.Writer, id int) error {
+	c, err := readConfigNoPush()
+	if err != nil {
+		return errors.Wrap(err, "error verifying config")
+	}
+
+	sources, err := c.loadSources(ctx)
+	if err != nil {
+		return err
+	}
+
+	probes, err := c.newProbeCache(sources)
+	if err != nil {
+		return errors.Wrap(err, "init cache")
+	}
+
+	vector, err := probes.QuerySource(ctx, id)
+	if errors.Cause(err) == promclient.ErrNoData {
+		fmt.Fprintln(out, "no data")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, sample := range vector {
+		fmt.Fprintln(out, sample)
+	}
+	return nil
+}
+
+// pushFile pushes every batch in the file at path, as written by a file sink,
+// to the configured sinks. Batches aren't sequenced: they may be sent to the
+// API more than once.
+func pushFile(ctx context.Context, path string) error {
+	c, err := ReadConfig()
+	if err != nil {
+		return errors.Wrap(err, "error verifying config")
+	}
+
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrap(err, "open batch file")
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if c.usesAPI() {
+		if err := c.initAuth(false); err != nil {
+			return errors.Wrap(err, "init auth")
+		}
+	}
+
+	sinks, err := c.initSinks(c.retryPolicy())
+	if err != nil {
+		return errors.Wrap(err, "init sinks")
+	}
+	defer sinks.Close()
+
+	r := bufio.NewReader(in)
+	batches, samples := 0, 0
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "read batch file")
+		}
+
+		if len(data) > 0 && string(data) != "\n" {
+			var batch map[int]prommodel.Vector
+			if err := json.Unmarshal(data, &batch); err != nil {
+				return errors.Wrapf(err, "line %d", line)
+			}
+			if err := sinks.Push(ctx, batch); err != nil {
+				return errors.Wrapf(err, "push line %d", line)
+			}
+
+			batches++
+			for _, vector := range batch {
+				samples += len(vector)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	log.Printf("pushed %d batch(es), %d sample(s)\n", batches, samples)
+	return nil
+}
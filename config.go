@@ -4,12 +4,20 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/MindsightCo/collector/apiclient"
 	"github.com/MindsightCo/collector/cache"
+	"github.com/MindsightCo/collector/health"
+	"github.com/MindsightCo/collector/sink"
+	"github.com/MindsightCo/collector/spool"
+	"github.com/MindsightCo/collector/telemetry"
 	auth0grant "github.com/ereyes01/go-auth0-grant"
 	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
 	"github.com/spf13/viper"
 )
 
@@ -19,6 +27,30 @@ const (
 	defaultCacheAge               = time.Minute * 5
 	defaultScrapeInterval         = time.Second * 5
 	defaultRefreshSourcesInterval = time.Hour
+	defaultSpoolMaxBytes          = 512 << 20
+	defaultSpoolMaxAge            = time.Hour * 24
+	defaultSpoolSegmentBytes      = 8 << 20
+	defaultSpoolDrainBatches      = 10
+	defaultPushMaxAttempts        = 5
+	defaultPushInitialBackoff     = time.Millisecond * 500
+	defaultPushMaxBackoff         = time.Second * 30
+	defaultPushBackoffJitter      = 0.2
+	defaultPushAttemptTimeout     = time.Second * 30
+	defaultMaxConcurrentQueries   = 10
+	defaultMaxQueriesPerServer    = 4
+	defaultRangeMaxLookback       = time.Hour
+	defaultHealthMaxScrapeAge     = time.Minute * 5
+	defaultHealthMaxPushAge       = time.Minute * 15
+	defaultHealthMaxRefreshAge    = time.Hour * 3
+	defaultShutdownGracePeriod    = time.Second * 10
+	defaultPushCompression        = apiclient.EncodingNone
+	defaultPushFormat             = apiclient.FormatJSON
+	defaultPushMaxBytes           = 4 << 20
+	defaultPushMaxSamples         = 10000
+	defaultSubscribeSources       = true
+	defaultSubscribeRetryInterval = time.Minute
+	defaultCacheMaxSamples        = 100000
+	defaultCacheOverflowPolicy    = cache.OverflowDropOldest
 
 	credsAudience = "https://api.mindsight.io/"
 	auth0TokenURL = "https://mindsight.auth0.com/oauth/token/"
@@ -26,29 +58,92 @@ const (
 
 type Config struct {
 	Sources                []cache.Source
+	SourcesDir             string `mapstructure:"sources_dir"`
+	SourceMode             string `mapstructure:"source_mode"`
+	SourcePrecedence       string `mapstructure:"source_precedence"`
+	Connections            map[string]cache.Connection
+	Sinks                  []SinkConfig
 	ClientID               string        `mapstructure:"client_id"`
 	ClientSecret           string        `mapstructure:"client_secret"`
 	APIServer              string        `mapstructure:"api_server"`
 	CacheAge               time.Duration `mapstructure:"cache_age"`
 	CacheDepth             int           `mapstructure:"cache_depth"`
+	CacheMaxSamples        int           `mapstructure:"cache_max_samples"`
+	CacheOverflowPolicy    string        `mapstructure:"cache_overflow_policy"`
 	ScrapeInterval         time.Duration `mapstructure:"scrape_interval"`
 	RefreshSourcesInterval time.Duration `mapstructure:"refresh_sources_interval"`
+	SpoolDir               string        `mapstructure:"spool_dir"`
+	SpoolMaxBytes          int64         `mapstructure:"spool_max_bytes"`
+	SpoolMaxAge            time.Duration `mapstructure:"spool_max_age"`
+	SpoolSegmentBytes      int64         `mapstructure:"spool_segment_bytes"`
+	SpoolDrainBatches      int           `mapstructure:"spool_drain_batches"`
+	PushMaxAttempts        int           `mapstructure:"push_max_attempts"`
+	PushInitialBackoff     time.Duration `mapstructure:"push_initial_backoff"`
+	PushMaxBackoff         time.Duration `mapstructure:"push_max_backoff"`
+	PushBackoffJitter      float64       `mapstructure:"push_backoff_jitter"`
+	PushAttemptTimeout     time.Duration `mapstructure:"push_attempt_timeout"`
+	MaxConcurrentQueries   int           `mapstructure:"max_concurrent_queries"`
+	MaxQueriesPerServer    int           `mapstructure:"max_queries_per_server"`
+	QueryTimeout           time.Duration `mapstructure:"query_timeout"`
+	RangeMaxLookback       time.Duration `mapstructure:"range_max_lookback"`
+	StateDir               string        `mapstructure:"state_dir"`
+	PushAbsenceMarkers     bool          `mapstructure:"push_absence_markers"`
+	ListenAddress          string        `mapstructure:"listen_address"`
+	HealthMaxScrapeAge     time.Duration `mapstructure:"health_max_scrape_age"`
+	HealthMaxPushAge       time.Duration `mapstructure:"health_max_push_age"`
+	HealthMaxRefreshAge    time.Duration `mapstructure:"health_max_refresh_age"`
+	ShutdownGracePeriod    time.Duration `mapstructure:"shutdown_grace_period"`
+	PushCompression        string        `mapstructure:"push_compression"`
+	PushCompressionLevel   int           `mapstructure:"push_compression_level"`
+	PushFormat             string        `mapstructure:"push_format"`
+	PushMaxBytes           int           `mapstructure:"push_max_bytes"`
+	PushMaxSamples         int           `mapstructure:"push_max_samples"`
+	InstanceID             string        `mapstructure:"instance_id"`
+	SubscribeSources       bool          `mapstructure:"subscribe_sources"`
+	SubscribeRetryInterval time.Duration `mapstructure:"subscribe_retry_interval"`
+	DryRun                 bool          `mapstructure:"dry_run"`
 
-	auth    *auth0grant.Grant
-	cache   *cache.Cache
-	pusher  *apiclient.MetricsPusher
-	queryer *apiclient.Queryer
+	auth       *grantAuth
+	apiSources []cache.Source
+	reloads    chan struct{}
+	cache      *cache.Cache
+	sinks      *sink.Fanout
+	queryer    *apiclient.Queryer
+	spool      *spool.Spool
+	server     *http.Server
+	health     *health.Tracker
+	drains     chan struct{}
+
+	// stopping is closed once the collector is told to stop. Batches that
+	// can't be pushed from then on are kept in unpushed, for the final flush.
+	stopping <-chan struct{}
+	unpushed []sequencedBatch
+
+	// seqMu guards seq, which drainSpool acknowledges batches in.
+	seqMu sync.Mutex
+	seq   sequenceState
 }
 
 // ReadConfig retrieves configuration values via viper. If a required
 // value was not provided, an error will be returned.
 func ReadConfig() (*Config, error) {
-	var c Config
+	return readConfig(false)
+}
 
-	viper.SetConfigName("mindsight-agent")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("/etc/mindsight/")
-	viper.SetConfigType("yaml")
+// readConfigNoPush is ReadConfig for commands that never push: credentials are
+// only required when sources come from the API.
+func readConfigNoPush() (*Config, error) {
+	return readConfig(true)
+}
+
+func readConfig(noPush bool) (*Config, error) {
+	// unless a config file was given on the command line
+	if viper.ConfigFileUsed() == "" {
+		viper.SetConfigName("mindsight-agent")
+		viper.AddConfigPath(".")
+		viper.AddConfigPath("/etc/mindsight/")
+		viper.SetConfigType("yaml")
+	}
 
 	// BUG: workaround for https://github.com/spf13/viper/issues/688
 	viper.BindEnv("client_id", "MINDSIGHT_CLIENT_ID")
@@ -56,8 +151,43 @@ func ReadConfig() (*Config, error) {
 	viper.BindEnv("api_server", "MINDSIGHT_API_SERVER")
 	viper.BindEnv("cache_age", "MINDSIGHT_CACHE_AGE")
 	viper.BindEnv("cache_depth", "MINDSIGHT_CACHE_DEPTH")
+	viper.BindEnv("cache_max_samples", "MINDSIGHT_CACHE_MAX_SAMPLES")
+	viper.BindEnv("cache_overflow_policy", "MINDSIGHT_CACHE_OVERFLOW_POLICY")
 	viper.BindEnv("scrape_interval", "MINDSIGHT_SCRAPE_INTERVAL")
 	viper.BindEnv("refresh_sources_interval", "MINDSIGHT_REFRESH_SOURCES_INTERVAL")
+	viper.BindEnv("spool_dir", "MINDSIGHT_SPOOL_DIR")
+	viper.BindEnv("spool_max_bytes", "MINDSIGHT_SPOOL_MAX_BYTES")
+	viper.BindEnv("spool_max_age", "MINDSIGHT_SPOOL_MAX_AGE")
+	viper.BindEnv("spool_segment_bytes", "MINDSIGHT_SPOOL_SEGMENT_BYTES")
+	viper.BindEnv("spool_drain_batches", "MINDSIGHT_SPOOL_DRAIN_BATCHES")
+	viper.BindEnv("push_max_attempts", "MINDSIGHT_PUSH_MAX_ATTEMPTS")
+	viper.BindEnv("push_initial_backoff", "MINDSIGHT_PUSH_INITIAL_BACKOFF")
+	viper.BindEnv("push_max_backoff", "MINDSIGHT_PUSH_MAX_BACKOFF")
+	viper.BindEnv("push_backoff_jitter", "MINDSIGHT_PUSH_BACKOFF_JITTER")
+	viper.BindEnv("push_attempt_timeout", "MINDSIGHT_PUSH_ATTEMPT_TIMEOUT")
+	viper.BindEnv("max_concurrent_queries", "MINDSIGHT_MAX_CONCURRENT_QUERIES")
+	viper.BindEnv("max_queries_per_server", "MINDSIGHT_MAX_QUERIES_PER_SERVER")
+	viper.BindEnv("query_timeout", "MINDSIGHT_QUERY_TIMEOUT")
+	viper.BindEnv("range_max_lookback", "MINDSIGHT_RANGE_MAX_LOOKBACK")
+	viper.BindEnv("state_dir", "MINDSIGHT_STATE_DIR")
+	viper.BindEnv("push_absence_markers", "MINDSIGHT_PUSH_ABSENCE_MARKERS")
+	viper.BindEnv("listen_address", "MINDSIGHT_LISTEN_ADDRESS")
+	viper.BindEnv("health_max_scrape_age", "MINDSIGHT_HEALTH_MAX_SCRAPE_AGE")
+	viper.BindEnv("health_max_push_age", "MINDSIGHT_HEALTH_MAX_PUSH_AGE")
+	viper.BindEnv("health_max_refresh_age", "MINDSIGHT_HEALTH_MAX_REFRESH_AGE")
+	viper.BindEnv("shutdown_grace_period", "MINDSIGHT_SHUTDOWN_GRACE_PERIOD")
+	viper.BindEnv("push_compression", "MINDSIGHT_PUSH_COMPRESSION")
+	viper.BindEnv("push_compression_level", "MINDSIGHT_PUSH_COMPRESSION_LEVEL")
+	viper.BindEnv("push_format", "MINDSIGHT_PUSH_FORMAT")
+	viper.BindEnv("push_max_bytes", "MINDSIGHT_PUSH_MAX_BYTES")
+	viper.BindEnv("push_max_samples", "MINDSIGHT_PUSH_MAX_SAMPLES")
+	viper.BindEnv("instance_id", "MINDSIGHT_INSTANCE_ID")
+	viper.BindEnv("subscribe_sources", "MINDSIGHT_SUBSCRIBE_SOURCES")
+	viper.BindEnv("subscribe_retry_interval", "MINDSIGHT_SUBSCRIBE_RETRY_INTERVAL")
+	viper.BindEnv("sources_dir", "MINDSIGHT_SOURCES_DIR")
+	viper.BindEnv("source_mode", "MINDSIGHT_SOURCE_MODE")
+	viper.BindEnv("source_precedence", "MINDSIGHT_SOURCE_PRECEDENCE")
+	viper.BindEnv("dry_run", "MINDSIGHT_DRY_RUN")
 
 	viper.SetEnvPrefix("mindsight")
 	viper.AutomaticEnv()
@@ -65,8 +195,34 @@ func ReadConfig() (*Config, error) {
 	viper.SetDefault("api_server", defaultAPIServer)
 	viper.SetDefault("cache_age", defaultCacheAge)
 	viper.SetDefault("cache_depth", defaultCacheDepth)
+	viper.SetDefault("cache_max_samples", defaultCacheMaxSamples)
+	viper.SetDefault("cache_overflow_policy", defaultCacheOverflowPolicy)
 	viper.SetDefault("scrape_interval", defaultScrapeInterval)
 	viper.SetDefault("refresh_sources_interval", defaultRefreshSourcesInterval)
+	viper.SetDefault("spool_max_bytes", defaultSpoolMaxBytes)
+	viper.SetDefault("spool_max_age", defaultSpoolMaxAge)
+	viper.SetDefault("spool_segment_bytes", defaultSpoolSegmentBytes)
+	viper.SetDefault("spool_drain_batches", defaultSpoolDrainBatches)
+	viper.SetDefault("push_max_attempts", defaultPushMaxAttempts)
+	viper.SetDefault("push_initial_backoff", defaultPushInitialBackoff)
+	viper.SetDefault("push_max_backoff", defaultPushMaxBackoff)
+	viper.SetDefault("push_backoff_jitter", defaultPushBackoffJitter)
+	viper.SetDefault("push_attempt_timeout", defaultPushAttemptTimeout)
+	viper.SetDefault("max_concurrent_queries", defaultMaxConcurrentQueries)
+	viper.SetDefault("max_queries_per_server", defaultMaxQueriesPerServer)
+	viper.SetDefault("range_max_lookback", defaultRangeMaxLookback)
+	viper.SetDefault("health_max_scrape_age", defaultHealthMaxScrapeAge)
+	viper.SetDefault("health_max_push_age", defaultHealthMaxPushAge)
+	viper.SetDefault("health_max_refresh_age", defaultHealthMaxRefreshAge)
+	viper.SetDefault("shutdown_grace_period", defaultShutdownGracePeriod)
+	viper.SetDefault("push_compression", defaultPushCompression)
+	viper.SetDefault("push_format", defaultPushFormat)
+	viper.SetDefault("push_max_bytes", defaultPushMaxBytes)
+	viper.SetDefault("push_max_samples", defaultPushMaxSamples)
+	viper.SetDefault("subscribe_sources", defaultSubscribeSources)
+	viper.SetDefault("subscribe_retry_interval", defaultSubscribeRetryInterval)
+	viper.SetDefault("source_mode", defaultSourceMode)
+	viper.SetDefault("source_precedence", defaultSourcePrecedence)
 
 	// loads viper config
 	err := viper.ReadInConfig()
@@ -74,15 +230,71 @@ func ReadConfig() (*Config, error) {
 		log.Println("(warning) Couldn't open config file:", err)
 	}
 
+	c, err := decodeConfig(noPush)
+	if err != nil {
+		return nil, err
+	}
+
+	c.reloads = make(chan struct{}, 1)
+	return c, nil
+}
+
+// decodeConfig unmarshals and checks the configuration viper has read. With
+// noPush, credentials aren't required just for pushing.
+func decodeConfig(noPush bool) (*Config, error) {
+	var c Config
+
 	if err := viper.Unmarshal(&c); err != nil {
 		return nil, errors.Wrap(err, "unmarshal configuration")
 	}
 
-	if c.ClientID == "" {
-		return nil, errors.New("env variable MINDSIGHT_CLIENT_ID (or config client_id) must be given")
+	if err := c.validSourceSettings(); err != nil {
+		return nil, err
+	}
+	if err := c.loadLocalSources(); err != nil {
+		return nil, errors.Wrap(err, "local sources")
 	}
-	if c.ClientSecret == "" {
-		return nil, errors.New("env variable MINDSIGHT_CLIENT_SECRET (or config client_secret) must be given")
+	if c.SourceMode == sourceModeLocal && len(c.Sources) == 0 {
+		return nil, errors.New("source_mode local requires sources in the config file or sources_dir")
+	}
+	if c.SourceMode == sourceModeAPI && len(c.Sources) > 0 {
+		log.Println("(warning) local sources are ignored with source_mode api")
+	}
+
+	// spilled data has to go somewhere on disk
+	if c.CacheOverflowPolicy == cache.OverflowSpill && c.SpoolDir == "" {
+		return nil, errors.New("cache_overflow_policy spill requires spool_dir")
+	}
+
+	// a dry run only prints what would be pushed, and leaves nothing on disk
+	if c.DryRun {
+		c.Sinks = []SinkConfig{{Type: sinkStdout}}
+		c.SpoolDir = ""
+		c.StateDir = ""
+	}
+
+	if len(c.Sinks) == 0 {
+		c.Sinks = defaultSinks
+	}
+
+	// credentials can only be left out when the API isn't used at all
+	needsAPI := c.usesAPI()
+	if noPush {
+		needsAPI = c.SourceMode != sourceModeLocal
+	}
+	if needsAPI {
+		if c.ClientID == "" {
+			return nil, errors.New("env variable MINDSIGHT_CLIENT_ID (or config client_id) must be given")
+		}
+		if c.ClientSecret == "" {
+			return nil, errors.New("env variable MINDSIGHT_CLIENT_SECRET (or config client_secret) must be given")
+		}
+	}
+
+	// by default a query may use up the whole scrape interval, so a slow
+	// server can't push a scrape past the next one
+	if c.QueryTimeout == 0 {
+		c.QueryTimeout = c.ScrapeInterval
 	}
 
 	return &c, nil
@@ -94,8 +306,45 @@ client secret: XXXX
 api_server: %s
 cache_age: %s
 cache_depth: %d
+cache_max_samples: %d
+cache_overflow_policy: %s
 scrape_interval: %s
 refresh_sources_interval: %s
+spool_dir: %s
+spool_max_bytes: %d
+spool_max_age: %s
+spool_segment_bytes: %d
+spool_drain_batches: %d
+push_max_attempts: %d
+push_initial_backoff: %s
+push_max_backoff: %s
+push_backoff_jitter: %g
+push_attempt_timeout: %s
+max_concurrent_queries: %d
+max_queries_per_server: %d
+query_timeout: %s
+range_max_lookback: %s
+state_dir: %s
+push_absence_markers: %t
+listen_address: %s
+health_max_scrape_age: %s
+health_max_push_age: %s
+health_max_refresh_age: %s
+shutdown_grace_period: %s
+push_compression: %s
+push_compression_level: %d
+push_format: %s
+push_max_bytes: %d
+push_max_samples: %d
+instance_id: %s
+subscribe_sources: %t
+subscribe_retry_interval: %s
+sinks: %s
+source_mode: %s
+source_precedence: %s
+sources_dir: %s
+local sources: %d
+dry_run: %t
 `
 
 func (c *Config) String() string {
@@ -103,125 +352,724 @@ func (c *Config) String() string {
 		return "<nil>"
 	}
 
-	return fmt.Sprintf(strFmt, c.ClientID, c.APIServer, c.CacheAge, c.CacheDepth, c.ScrapeInterval, c.RefreshSourcesInterval)
+	return fmt.Sprintf(strFmt, c.ClientID, c.APIServer, c.CacheAge, c.CacheDepth, c.CacheMaxSamples, c.CacheOverflowPolicy, c.ScrapeInterval, c.RefreshSourcesInterval,
+		c.SpoolDir, c.SpoolMaxBytes, c.SpoolMaxAge, c.SpoolSegmentBytes, c.SpoolDrainBatches,
+		c.PushMaxAttempts, c.PushInitialBackoff, c.PushMaxBackoff, c.PushBackoffJitter, c.PushAttemptTimeout,
+		c.MaxConcurrentQueries, c.MaxQueriesPerServer, c.QueryTimeout,
+		c.RangeMaxLookback, c.StateDir, c.PushAbsenceMarkers, c.ListenAddress,
+		c.HealthMaxScrapeAge, c.HealthMaxPushAge, c.HealthMaxRefreshAge, c.ShutdownGracePeriod,
+		c.PushCompression, c.PushCompressionLevel, c.PushFormat,
+		c.PushMaxBytes, c.PushMaxSamples, c.InstanceID,
+		c.SubscribeSources, c.SubscribeRetryInterval, c.sinkNames(),
+		c.SourceMode, c.SourcePrecedence, c.SourcesDir, len(c.Sources), c.DryRun)
 }
 
-func (c *Config) initAuth() error {
-	credRequest := auth0grant.CredentialsRequest{
+func (c *Config) credentialsRequest() auth0grant.CredentialsRequest {
+	return auth0grant.CredentialsRequest{
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
 		Audience:     credsAudience,
 		GrantType:    auth0grant.CLIENT_CREDS_GRANT_TYPE,
 	}
+}
 
-	grant := auth0grant.NewGrant(auth0TokenURL, credRequest)
+// initAuth sets up the API credentials. With test, a token is requested right
+// away so that bad credentials are caught at startup.
+func (c *Config) initAuth(test bool) error {
+	grant := newGrantAuth(auth0TokenURL, c.credentialsRequest())
 
-	// test the token
-	if _, err := grant.GetAccessToken(); err != nil {
-		return errors.Wrap(err, "testing credentials")
+	if test {
+		if _, err := grant.GetAccessToken(); err != nil {
+			return errors.Wrap(err, "testing credentials")
+		}
 	}
 
 	c.auth = grant
 	return nil
 }
 
-func (c *Config) init() error {
+func (c *Config) init(ctx context.Context) error {
 	log.Println(c.String())
 
-	if err := c.initAuth(); err != nil {
-		return errors.Wrap(err, "init auth")
+	// in local mode the API is only pushed to, which may wait until it can
+	// be reached: the collector must be able to start offline
+	if c.usesAPI() {
+		if err := c.initAuth(c.SourceMode != sourceModeLocal); err != nil {
+			return errors.Wrap(err, "init auth")
+		}
 	}
 
-	cache, err := cache.NewCache(c.Sources, c.CacheDepth, c.CacheAge)
+	// sources are set by the refresh below
+	cache, err := cache.NewCache(nil, c.CacheDepth, c.CacheAge,
+		cache.WithConcurrency(c.MaxConcurrentQueries),
+		cache.WithPerURLConcurrency(c.MaxQueriesPerServer),
+		cache.WithQueryTimeout(c.QueryTimeout),
+		cache.WithDefaultInterval(c.ScrapeInterval),
+		cache.WithMaxLookback(c.RangeMaxLookback),
+		cache.WithAbsenceMarkers(c.PushAbsenceMarkers),
+		cache.WithConnections(c.Connections),
+		cache.WithMaxSamples(c.CacheMaxSamples, c.CacheOverflowPolicy))
 	if err != nil {
 		return errors.Wrap(err, "init cache")
 	}
 
-	pusher, err := apiclient.NewMetricsPusher(c.APIServer, c.auth)
-	if err != nil {
-		return errors.Wrap(err, "init metrics pusher")
+	if c.StateDir != "" {
+		if err := os.MkdirAll(c.StateDir, 0755); err != nil {
+			return errors.Wrap(err, "create state directory")
+		}
+
+		checkpoints, err := loadCheckpoints(c.StateDir)
+		if err != nil {
+			return errors.Wrap(err, "init checkpoints")
+		}
+		cache.RestoreCheckpoints(checkpoints)
 	}
 
-	queryer, err := apiclient.NewQueryer(c.APIServer, c.auth)
+	if err := c.initSequence(); err != nil {
+		return errors.Wrap(err, "init batch sequence")
+	}
+
+	sinks, err := c.initSinks(c.retryPolicy())
 	if err != nil {
-		return errors.Wrap(err, "init queryer")
+		return errors.Wrap(err, "init sinks")
+	}
+
+	var queryer *apiclient.Queryer
+	if c.SourceMode != sourceModeLocal {
+		queryer, err = apiclient.NewQueryer(c.APIServer, c.auth)
+		if err != nil {
+			return errors.Wrap(err, "init queryer")
+		}
+	}
+
+	if c.SpoolDir != "" {
+		spool, err := spool.Open(c.SpoolDir, spool.Options{
+			SegmentBytes: c.SpoolSegmentBytes,
+			MaxBytes:     c.SpoolMaxBytes,
+			MaxAge:       c.SpoolMaxAge,
+		})
+		if err != nil {
+			return errors.Wrap(err, "init spool")
+		}
+		c.spool = spool
+		c.drains = make(chan struct{}, 1)
 	}
 
 	c.cache = cache
-	c.pusher = pusher
+	c.sinks = sinks
 	c.queryer = queryer
 
-	if err := c.refreshSources(context.Background()); err != nil {
+	if err := c.refreshSources(ctx); err != nil {
 		return errors.Wrap(err, "init refresh sources")
 	}
 
+	c.health.Initialized()
 	return nil
 }
 
+func (c *Config) retryPolicy() apiclient.RetryPolicy {
+	retry := apiclient.DefaultRetryPolicy
+	retry.MaxAttempts = c.PushMaxAttempts
+	retry.InitialBackoff = c.PushInitialBackoff
+	retry.MaxBackoff = c.PushMaxBackoff
+	retry.Jitter = c.PushBackoffJitter
+	retry.AttemptTimeout = c.PushAttemptTimeout
+
+	return retry
+}
+
+// initSequence restores the instance ID and batch sequence saved in the state
+// directory. Without one, sequence numbers start from the current time so
+// they keep increasing across restarts, and the instance ID changes on every
+// restart unless it is configured.
+func (c *Config) initSequence() error {
+	if c.StateDir != "" {
+		state, err := loadSequence(c.StateDir)
+		if err != nil {
+			return err
+		}
+		c.seq = state
+	} else {
+		c.seq.LastSeq = uint64(time.Now().UnixNano())
+	}
+
+	if c.InstanceID != "" {
+		c.seq.InstanceID = c.InstanceID
+	}
+	if c.seq.InstanceID == "" {
+		id, err := newInstanceID()
+		if err != nil {
+			return errors.Wrap(err, "generate instance id")
+		}
+		c.seq.InstanceID = id
+	}
+
+	log.Println("instance id:", c.seq.InstanceID)
+	return c.saveSequence()
+}
+
+func (c *Config) saveSequence() error {
+	if c.StateDir == "" {
+		return nil
+	}
+
+	return saveSequence(c.StateDir, c.seq)
+}
+
+// nextSeq returns the sequence number of a new batch. It's saved right away,
+// so that it's never handed out again.
+func (c *Config) nextSeq() uint64 {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+
+	c.seq.LastSeq++
+	if err := c.saveSequence(); err != nil {
+		log.Println("WARNING (push): save sequence state:", err)
+	}
+
+	return c.seq.LastSeq
+}
+
+// ackSeq records that every batch up to seq has been delivered.
+func (c *Config) ackSeq(seq uint64) {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+
+	if seq <= c.seq.AckedSeq {
+		return
+	}
+
+	c.seq.AckedSeq = seq
+	if err := c.saveSequence(); err != nil {
+		log.Println("WARNING (push): save sequence state:", err)
+	}
+}
+
 func (c *Config) scrape(ctx context.Context) error {
 	data, err := c.cache.Collect(ctx)
-	if err != nil {
+	if collectErr, ok := err.(*cache.CollectError); ok {
+		for _, failure := range collectErr.Failures {
+			log.Println("WARNING (scrape):", failure)
+		}
+		if len(collectErr.Failures) < collectErr.NSources {
+			c.health.Succeeded(health.Scrape)
+		}
+	} else if err != nil {
 		return errors.Wrap(err, "scrape")
+	} else {
+		c.health.Succeeded(health.Scrape)
+	}
+
+	if err := c.push(ctx, data); err != nil {
+		return errors.Wrap(err, "push from scrape")
 	}
 
-	if data != nil {
-		if err := c.pusher.Push(ctx, data); err != nil {
-			return errors.Wrap(err, "push from scrape")
+	// the flushed data covers everything collected so far, so range sources
+	// can resume from here after a restart
+	if data != nil && c.StateDir != "" {
+		if err := saveCheckpoints(c.StateDir, c.cache.Checkpoints()); err != nil {
+			return errors.Wrap(err, "save checkpoints")
 		}
 	}
 
 	return nil
 }
 
+// push sends data to every sink. When a spool is configured, data is only
+// written to disk here and drainSpool pushes it on its own goroutine, so a
+// sink that's down never holds up scraping, and batches that couldn't be
+// pushed are retried later (and after a restart) instead of being dropped.
+func (c *Config) push(ctx context.Context, data map[int]prommodel.Vector) error {
+	if c.spool != nil {
+		return c.spoolBatch(ctx, data)
+	}
+
+	if err := c.deliver(ctx, data); err != nil {
+		return err
+	}
+
+	// having nothing to push also counts, what matters is that pushes aren't
+	// failing
+	c.health.Succeeded(health.Push)
+	return nil
+}
+
+// deliver pushes data straight to the sinks. Failed pushes are only retried
+// for up to a scrape interval, so that the next scrape isn't held up for long.
+func (c *Config) deliver(ctx context.Context, data map[int]prommodel.Vector) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return c.pushDirect(ctx, c.nextSeq(), data)
+}
+
+// sequencedBatch is a batch along with its sequence number.
+type sequencedBatch struct {
+	seq  uint64
+	data map[int]prommodel.Vector
+}
+
+// pushDirect pushes the batch seq to the sinks, bypassing the spool. Once the
+// collector is stopping, a batch that can't be pushed is handed to the final
+// flush instead of being dropped.
+func (c *Config) pushDirect(ctx context.Context, seq uint64, data map[int]prommodel.Vector) error {
+	if err := c.sinks.PushBatch(c.retryUntilNextScrape(ctx), seq, data); err != nil {
+		if c.isStopping() {
+			c.unpushed = append(c.unpushed, sequencedBatch{seq: seq, data: data})
+		}
+		return err
+	}
+
+	c.ackSeq(seq)
+	return nil
+}
+
+func (c *Config) isStopping() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// spoolBatch appends data to the spool, and has drainSpool push it along with
+// anything spooled before.
+func (c *Config) spoolBatch(ctx context.Context, data map[int]prommodel.Vector) error {
+	defer c.requestDrain()
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	seq := c.nextSeq()
+	if err := c.spool.Append(seq, data); err != nil {
+		// not acknowledged, it would skip ahead of the batches still spooled
+		log.Println("WARNING (spool): couldn't spool data, pushing directly:", err)
+		return c.pushDirect(ctx, seq, data)
+	}
+
+	return nil
+}
+
+// retryUntilNextScrape returns a copy of ctx under which pushes aren't
+// retried for longer than a scrape interval.
+func (c *Config) retryUntilNextScrape(ctx context.Context) context.Context {
+	return apiclient.RetryUntil(ctx, time.Now().Add(c.ScrapeInterval))
+}
+
+// requestDrain has drainSpool push the spooled batches. Requests made while
+// one is already pending are merged into it.
+func (c *Config) requestDrain() {
+	select {
+	case c.drains <- struct{}{}:
+	default:
+	}
+}
+
+// drainSpool pushes spooled batches every time a drain is requested, which
+// push does on every scrape, until ctx is done. Each batch is only attempted
+// once: the spool already keeps it, so one that fails is left for the next
+// drain rather than retried here. A drain pushes at most spool_drain_batches
+// batches, so the backlog an outage leaves behind doesn't flood the sinks.
+func (c *Config) drainSpool(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.drains:
+		}
+
+		if err := c.spool.Drain(apiclient.SingleAttempt(ctx), c.SpoolDrainBatches, c.pushSpooled); err != nil {
+			if ctx.Err() == nil {
+				log.Println("WARNING (push):", err)
+			}
+			continue
+		}
+
+		// having nothing to push also counts, what matters is that pushes
+		// aren't failing
+		c.health.Succeeded(health.Push)
+	}
+}
+
+// pushSpooled pushes a batch read back from the spool. The spool is drained
+// in order, so a batch at or below the acknowledged sequence number was
+// already delivered, before a crash kept the spool from recording it. A batch
+// some sink rejects permanently is dropped for that sink by the fan-out, so
+// it can't block every batch spooled after it.
+func (c *Config) pushSpooled(ctx context.Context, seq uint64, data map[int]prommodel.Vector) error {
+	c.seqMu.Lock()
+	acked := seq != 0 && seq <= c.seq.AckedSeq
+	c.seqMu.Unlock()
+	if acked {
+		return nil
+	}
+
+	if err := c.sinks.PushBatch(ctx, seq, data); err != nil {
+		return err
+	}
+
+	c.ackSeq(seq)
+	return nil
+}
+
+// refreshSources polls the API for sources, unless they only come from the
+// configuration, and applies them.
 func (c *Config) refreshSources(ctx context.Context) error {
+	if c.SourceMode == sourceModeLocal {
+		return c.setSources(ctx, nil)
+	}
+
 	sources, err := c.queryer.QuerySources(ctx)
 	if err != nil {
+		telemetry.SourceRefreshes.WithLabelValues("failure").Inc()
 		return errors.Wrap(err, "query sources")
 	}
+	telemetry.SourceRefreshes.WithLabelValues("success").Inc()
 
-	log.Println("new metric sources:")
-	for _, src := range sources {
-		log.Printf("(id:%d) server:%s query:%s\n", src.SourceID, src.URL, src.Query)
+	return c.setSources(ctx, sources)
+}
+
+// setSources replaces the cache's sources with apiSources combined with the
+// local ones, pushing whatever the cache flushes as a result.
+func (c *Config) setSources(ctx context.Context, apiSources []cache.Source) error {
+	data, err := c.replaceSources(apiSources)
+	if err != nil {
+		return err
+	}
+
+	if err := c.push(ctx, data); err != nil {
+		return errors.Wrap(err, "push after refresh sources")
 	}
 
-	data, err := c.cache.NewSources(sources)
+	c.health.Succeeded(health.RefreshSources)
+	return nil
+}
+
+// replaceSources gives the cache apiSources combined with the local ones, and
+// returns the data it flushed. The cache is left as it was on error.
+func (c *Config) replaceSources(apiSources []cache.Source) (map[int]prommodel.Vector, error) {
+	sources := c.combineSources(apiSources)
+	data, changes, err := c.cache.NewSources(sources)
 	if err != nil {
-		return errors.Wrap(err, "set new sources")
+		return nil, errors.Wrap(err, "set new sources")
 	}
+	c.apiSources = apiSources
+	c.setScrapeThreshold()
 
-	if data != nil {
-		if err := c.pusher.Push(ctx, data); err != nil {
-			return errors.Wrap(err, "push after refresh sources")
+	if changes.Changed() {
+		log.Println("metric sources changed,", changes)
+		for _, src := range sources {
+			log.Printf("(id:%d) server:%s query:%s\n", src.SourceID, src.URL, src.Query)
+		}
+	}
+	for _, src := range sources {
+		if err, present := changes.Quarantined[src.SourceID]; present {
+			log.Printf("WARNING (sources): source %d quarantined: %v\n", src.SourceID, err)
+		}
+		for _, warning := range changes.Warnings[src.SourceID] {
+			log.Printf("WARNING (sources): source %d: %s\n", src.SourceID, warning)
 		}
 	}
 
-	return nil
+	return data, nil
+}
+
+// setScrapeThreshold has scrapes considered stale once none has succeeded for
+// health_max_scrape_age, past the longest interval between two runs of a
+// source: a source with a long interval mustn't get the collector restarted
+// while it waits to run again.
+func (c *Config) setScrapeThreshold() {
+	c.health.SetThreshold(health.Scrape, scrapeThreshold(c.HealthMaxScrapeAge, c.ScrapeInterval, c.combineSources(c.apiSources)))
+}
+
+func scrapeThreshold(maxAge, defaultInterval time.Duration, sources []cache.Source) time.Duration {
+	if maxAge <= 0 {
+		return 0
+	}
+
+	longest := defaultInterval
+	for _, src := range sources {
+		if src.Interval > longest {
+			longest = src.Interval
+		}
+	}
+
+	return maxAge + longest
+}
+
+// untilNextScrape returns how long to wait until the next source is due to be
+// queried, or until the cache is due to be flushed for its age if that's
+// sooner, so that sources with long intervals don't hold back flushed data.
+// Without any sources, the cache is still checked every scrape interval.
+func (c *Config) untilNextScrape() time.Duration {
+	next, ok := c.cache.NextRun()
+	if !ok {
+		next = time.Now().Add(c.ScrapeInterval)
+	}
+	if flush := c.cache.NextFlush(); flush.Before(next) {
+		next = flush
+	}
+
+	if wait := time.Until(next); wait > 0 {
+		return wait
+	}
+	return 0
 }
 
-func (c *Config) Loop() error {
-	if err := c.init(); err != nil {
+// Loop runs the collector until ctx is cancelled. It then flushes the cache
+// and returns nil, or a *FlushError if the cached data couldn't be saved.
+// Work that's under way when ctx is cancelled, such as a push, isn't cut
+// short: it gets until the end of the shutdown grace period, along with the
+// final flush.
+func (c *Config) Loop(ctx context.Context) error {
+	c.health = health.NewTracker(health.Thresholds{
+		health.Scrape:         c.HealthMaxScrapeAge,
+		health.Push:           c.HealthMaxPushAge,
+		health.RefreshSources: c.HealthMaxRefreshAge,
+	})
+
+	if c.ListenAddress != "" {
+		if err := c.serveHTTP(); err != nil {
+			return errors.Wrap(err, "start http listener")
+		}
+	}
+
+	if err := c.init(ctx); err != nil {
 		return errors.Wrap(err, "init metrics collector")
 	}
 
-	scrapeTimer := time.NewTimer(c.ScrapeInterval)
+	pushCtx, cancelPushes := graceContext(ctx, c.ShutdownGracePeriod)
+	defer cancelPushes()
+	c.stopping = ctx.Done()
+
+	var draining sync.WaitGroup
+	if c.spool != nil {
+		draining.Add(1)
+		go func() {
+			defer draining.Done()
+			c.drainSpool(ctx)
+		}()
+	}
+
+	scrapeTimer := time.NewTimer(c.untilNextScrape())
 	refreshSourcesTimer := time.NewTimer(c.RefreshSourcesInterval)
-	ctx := context.Background()
+
+	// source updates come from the subscription while it's up, polling is
+	// only the fallback for when it's down
+	var sub *apiclient.Subscription
+	var sourceUpdates <-chan []cache.Source
+	missedUpdates := false
+	subscribeFailures := 0
+	resubscribeTimer := time.NewTimer(0)
+	if !c.SubscribeSources || c.SourceMode == sourceModeLocal {
+		resubscribeTimer.Stop()
+	}
 
 	for {
 		select {
+		case <-ctx.Done():
+			scrapeTimer.Stop()
+			refreshSourcesTimer.Stop()
+			resubscribeTimer.Stop()
+			if sub != nil {
+				sub.Close()
+			}
+			// shutdown drains the spool one last time
+			draining.Wait()
+
+			log.Println("shutting down")
+			return c.shutdown(pushCtx)
+
+		case <-resubscribeTimer.C:
+			var err error
+			sub, err = c.queryer.SubscribeSources(ctx)
+			if err != nil {
+				// the API may not offer subscriptions at all: say so once,
+				// then keep polling quietly, retrying less and less often
+				if subscribeFailures == 0 {
+					log.Println("WARNING (subscribeSources): polling for sources until subscribing works:", err)
+				}
+				subscribeFailures++
+				missedUpdates = true
+				resubscribeTimer.Reset(c.subscribeRetryWait(subscribeFailures))
+				continue
+			}
+			subscribeFailures = 0
+			sourceUpdates = sub.Updates
+			log.Println("subscribed to metric source updates")
+
+			// sources may have changed since they were last polled
+			if missedUpdates {
+				if err := c.refreshSources(pushCtx); err != nil {
+					log.Println("WARNING (refreshSources):", err)
+				} else {
+					missedUpdates = false
+				}
+			}
+
+		case sources, ok := <-sourceUpdates:
+			if !ok {
+				log.Println("WARNING (subscribeSources): falling back to polling:", sub.Err())
+				sub, sourceUpdates = nil, nil
+				missedUpdates = true
+				// the fallback was just reported, failing to subscribe
+				// again needn't be
+				subscribeFailures = 1
+				resubscribeTimer.Reset(c.SubscribeRetryInterval)
+				continue
+			}
+
+			if err := c.setSources(pushCtx, sources); err != nil {
+				log.Println("WARNING (subscribeSources):", err)
+			}
+
+		case <-c.reloads:
+			refreshInterval := c.RefreshSourcesInterval
+			if err := c.reload(pushCtx); err != nil {
+				log.Println("WARNING (reload): keeping the running config:", err)
+				continue
+			}
+
+			// sources or the scrape interval may have changed
+			resetTimer(scrapeTimer, c.untilNextScrape())
+			if c.RefreshSourcesInterval != refreshInterval {
+				resetTimer(refreshSourcesTimer, c.RefreshSourcesInterval)
+			}
+
 		case <-scrapeTimer.C:
-			if err := c.scrape(ctx); err != nil {
+			if err := c.scrape(pushCtx); err != nil {
 				log.Println("WARNING (scrape):", err)
 			}
-			scrapeTimer.Reset(c.ScrapeInterval)
+			scrapeTimer.Reset(c.untilNextScrape())
 
-		// TODO: instead of a timer, replace with a subscription notification
-		// from the API
 		case <-refreshSourcesTimer.C:
-			if err := c.refreshSources(ctx); err != nil {
+			if sub != nil && !missedUpdates {
+				// the subscription keeps the sources up to date
+				c.health.Succeeded(health.RefreshSources)
+			} else if err := c.refreshSources(pushCtx); err != nil {
 				log.Println("WARNING (refreshSources):", err)
+			} else if sub != nil {
+				missedUpdates = false
 			}
 			refreshSourcesTimer.Reset(c.RefreshSourcesInterval)
 		}
 	}
 }
+
+// subscribeRetryWait returns how long to wait before subscribing again, after
+// the given number of failures in a row. The wait starts at
+// subscribe_retry_interval and doubles with every failure, up to
+// refresh_sources_interval: sources are polled in the meantime anyway.
+func (c *Config) subscribeRetryWait(failures int) time.Duration {
+	limit := c.RefreshSourcesInterval
+	if limit < c.SubscribeRetryInterval {
+		limit = c.SubscribeRetryInterval
+	}
+
+	wait := c.SubscribeRetryInterval
+	for i := 1; i < failures && wait < limit; i++ {
+		wait *= 2
+	}
+	if wait > limit {
+		return limit
+	}
+	return wait
+}
+
+// graceContext returns a context that's done the grace period after ctx is,
+// or once cancelled.
+func graceContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-graceCtx.Done():
+			return
+		}
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			cancel()
+		case <-graceCtx.Done():
+		}
+	}()
+
+	return graceCtx, cancel
+}
+
+// FlushError is returned by Loop when the data left in the cache at shutdown
+// could be neither pushed nor spooled, and was lost.
+type FlushError struct {
+	Err error
+}
+
+func (e *FlushError) Error() string {
+	return "final flush: " + e.Err.Error()
+}
+
+// shutdown saves everything left in the cache, until ctx is done, and
+// releases the collector's resources. Batches that couldn't be pushed since
+// the collector was told to stop are pushed again first. With a spool, the
+// data only needs to reach the spool; draining it is best effort.
+func (c *Config) shutdown(ctx context.Context) error {
+	var flushErr error
+	for _, batch := range c.unpushed {
+		if err := c.sinks.PushBatch(ctx, batch.seq, batch.data); err != nil {
+			flushErr = &FlushError{Err: errors.Wrap(err, "push")}
+		} else {
+			c.ackSeq(batch.seq)
+		}
+	}
+
+	data := c.cache.Flush()
+
+	var seq uint64
+	if len(data) > 0 {
+		seq = c.nextSeq()
+	}
+
+	if c.spool != nil {
+		if err := c.spool.Append(seq, data); err != nil {
+			flushErr = &FlushError{Err: errors.Wrap(err, "spool")}
+		} else if err := c.spool.Drain(ctx, 0, c.pushSpooled); err != nil {
+			log.Println("WARNING (shutdown): data left in spool:", err)
+		}
+	} else if seq != 0 {
+		if err := c.sinks.PushBatch(ctx, seq, data); err != nil {
+			flushErr = &FlushError{Err: errors.Wrap(err, "push")}
+		} else {
+			c.ackSeq(seq)
+		}
+	}
+
+	if flushErr == nil && c.StateDir != "" {
+		if err := saveCheckpoints(c.StateDir, c.cache.Checkpoints()); err != nil {
+			log.Println("WARNING (shutdown): save checkpoints:", err)
+		}
+	}
+
+	if c.spool != nil {
+		if err := c.spool.Close(); err != nil {
+			log.Println("WARNING (shutdown): close spool:", err)
+		}
+	}
+
+	if err := c.sinks.Close(); err != nil {
+		log.Println("WARNING (shutdown):", err)
+	}
+
+	if c.server != nil {
+		if err := c.server.Shutdown(ctx); err != nil {
+			log.Println("WARNING (shutdown): stop http listener:", err)
+		}
+	}
+
+	return flushErr
+}
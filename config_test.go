@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MindsightCo/collector/cache"
+	"github.com/MindsightCo/collector/spool"
+)
+
+// promServer answers every query with a single sample, counting the queries.
+func promServer(t *testing.T, queries *int32) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(queries, 1)
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[%d,"1"]}]}}`,
+			time.Now().Unix())
+	}))
+}
+
+// testConfig returns a configuration running a single local source against
+// promURL, pushing every sample to a webhook at sinkURL.
+func testConfig(promURL, sinkURL string) *Config {
+	return &Config{
+		Sources:                []cache.Source{{SourceID: 1, URL: promURL, Query: "up"}},
+		SourceMode:             sourceModeLocal,
+		SourcePrecedence:       precedenceLocal,
+		Sinks:                  []SinkConfig{{Type: sinkWebhook, URL: sinkURL}},
+		CacheAge:               time.Minute,
+		CacheDepth:             1,
+		ScrapeInterval:         time.Millisecond * 20,
+		RefreshSourcesInterval: time.Hour,
+		QueryTimeout:           time.Second,
+		PushMaxAttempts:        5,
+		PushInitialBackoff:     time.Millisecond * 10,
+		PushMaxBackoff:         time.Millisecond * 10,
+		PushAttemptTimeout:     time.Minute,
+		SpoolDrainBatches:      defaultSpoolDrainBatches,
+		ShutdownGracePeriod:    time.Millisecond * 100,
+		reloads:                make(chan struct{}, 1),
+	}
+}
+
+func TestSpoolDoesNotDelayScrapes(t *testing.T) {
+	var queries int32
+	prom := promServer(t, &queries)
+	defer prom.Close()
+
+	// the sink hangs until the test is over
+	release := make(chan struct{})
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer sinkServer.Close()
+	defer close(release)
+
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal("create temp dir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := testConfig(prom.URL, sinkServer.URL)
+	c.SpoolDir = dir
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Loop(ctx) }()
+
+	time.Sleep(time.Millisecond * 500)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal("loop:", err)
+	}
+
+	// scrapes run every 20ms, they'd stop at the first one if they waited for
+	// the sink
+	if n := atomic.LoadInt32(&queries); n < 5 {
+		t.Fatal("scrapes were held up by the sink, queries:", n)
+	}
+
+	s, err := spool.Open(dir, spool.Options{})
+	if err != nil {
+		t.Fatal("reopen spool:", err)
+	}
+	defer s.Close()
+	if !s.Pending() {
+		t.Fatal("batches the sink didn't take were not left in the spool")
+	}
+}
+
+// runLoop runs c until stopAfter has passed, and returns what Loop returned.
+func runLoop(t *testing.T, c *Config, stopAfter time.Duration) error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Loop(ctx) }()
+
+	time.Sleep(stopAfter)
+	cancel()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second * 10):
+		t.Fatal("loop didn't stop")
+		return nil
+	}
+}
+
+func TestShutdownFinishesPush(t *testing.T) {
+	var queries int32
+	prom := promServer(t, &queries)
+	defer prom.Close()
+
+	// every push is still in flight a while after it's made, and only counts
+	// if the collector waits for it
+	var pushed int32
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Millisecond * 100):
+			atomic.AddInt32(&pushed, 1)
+		case <-r.Context().Done():
+		}
+	}))
+	defer sinkServer.Close()
+
+	c := testConfig(prom.URL, sinkServer.URL)
+	c.ShutdownGracePeriod = time.Second
+
+	if err := runLoop(t, c, time.Millisecond*250); err != nil {
+		t.Fatal("loop:", err)
+	}
+
+	// the cache holds a single sample, each query's is pushed on its own
+	if q, p := atomic.LoadInt32(&queries), atomic.LoadInt32(&pushed); p != q {
+		t.Fatalf("samples lost at shutdown, queries: %d pushes: %d", q, p)
+	}
+}
+
+func TestShutdownFlushError(t *testing.T) {
+	var queries int32
+	prom := promServer(t, &queries)
+	defer prom.Close()
+
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 50)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer sinkServer.Close()
+
+	c := testConfig(prom.URL, sinkServer.URL)
+	c.ShutdownGracePeriod = time.Millisecond * 200
+
+	// the push in flight when the collector stops fails, the final flush
+	// has to report it
+	err := runLoop(t, c, time.Millisecond*120)
+	if _, ok := err.(*FlushError); !ok {
+		t.Fatal("expected a flush error, got:", err)
+	}
+}
+
+func TestScrapeThreshold(t *testing.T) {
+	var cases = []struct {
+		name     string
+		maxAge   time.Duration
+		sources  []cache.Source
+		expected time.Duration
+	}{
+		{
+			name:     "default interval",
+			maxAge:   time.Minute * 5,
+			sources:  []cache.Source{{SourceID: 1}},
+			expected: time.Minute*5 + time.Second*5,
+		},
+		{
+			name:     "longest source interval",
+			maxAge:   time.Minute * 5,
+			sources:  []cache.Source{{SourceID: 1, Interval: time.Minute}, {SourceID: 2, Interval: time.Hour}},
+			expected: time.Minute*5 + time.Hour,
+		},
+		{
+			name:     "disabled",
+			sources:  []cache.Source{{SourceID: 1, Interval: time.Hour}},
+			expected: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := scrapeThreshold(tc.maxAge, time.Second*5, tc.sources); got != tc.expected {
+				t.Fatalf("threshold got: %s expected: %s", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestUntilNextScrape(t *testing.T) {
+	var queries int32
+	prom := promServer(t, &queries)
+	defer prom.Close()
+
+	c := &Config{ScrapeInterval: time.Second * 5}
+
+	var err error
+	c.cache, err = cache.NewCache(nil, 100, time.Hour)
+	if err != nil {
+		t.Fatal("new cache:", err)
+	}
+	if wait := c.untilNextScrape(); wait <= time.Second*4 || wait > time.Second*5 {
+		t.Fatal("without sources, unexpected wait:", wait)
+	}
+
+	// the source isn't due for an hour, but the cache has to be flushed
+	// within a minute
+	sources := []cache.Source{{SourceID: 1, URL: prom.URL, Query: "up", Interval: time.Hour}}
+	c.cache, err = cache.NewCache(sources, 100, time.Minute)
+	if err != nil {
+		t.Fatal("new cache:", err)
+	}
+	if _, err := c.cache.Collect(context.Background()); err != nil {
+		t.Fatal("collect:", err)
+	}
+	if wait := c.untilNextScrape(); wait <= time.Second*55 || wait > time.Minute {
+		t.Fatal("with a long source interval, unexpected wait:", wait)
+	}
+}
+
+func TestSubscribeRetryWait(t *testing.T) {
+	c := &Config{SubscribeRetryInterval: time.Minute, RefreshSourcesInterval: time.Hour}
+
+	var cases = []struct {
+		failures int
+		expected time.Duration
+	}{
+		{failures: 1, expected: time.Minute},
+		{failures: 2, expected: time.Minute * 2},
+		{failures: 4, expected: time.Minute * 8},
+		{failures: 7, expected: time.Hour},
+		{failures: 100, expected: time.Hour},
+	}
+
+	for _, tc := range cases {
+		if got := c.subscribeRetryWait(tc.failures); got != tc.expected {
+			t.Fatalf("after %d failures, wait got: %s expected: %s", tc.failures, got, tc.expected)
+		}
+	}
+}
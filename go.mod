@@ -4,12 +4,19 @@ go 1.12
 
 require (
 	github.com/ereyes01/go-auth0-grant v1.0.0
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/golang/mock v1.3.1
+	github.com/golang/snappy v0.0.1
 	github.com/google/go-cmp v0.3.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/klauspost/compress v1.9.8
 	github.com/machinebox/graphql v0.2.2
 	github.com/matryer/is v1.2.0 // indirect
 	github.com/pkg/errors v0.8.1
 	github.com/prometheus/client_golang v1.0.0
 	github.com/prometheus/common v0.6.0
+	github.com/prometheus/prometheus v1.8.2-0.20190710134608-e5b22494857d
+	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.4.0
 )
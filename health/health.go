@@ -0,0 +1,157 @@
+// package health tracks when the collector last did its work successfully,
+// and serves liveness and readiness endpoints derived from that.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Activities tracked by a Tracker.
+const (
+	Scrape         = "scrape"
+	Push           = "push"
+	RefreshSources = "refresh_sources"
+)
+
+// Thresholds are how long each activity may go without succeeding before the
+// collector is considered unhealthy. A zero threshold disables the check.
+type Thresholds map[string]time.Duration
+
+// Tracker records the collector's progress. It is safe for concurrent use.
+type Tracker struct {
+	mu          sync.Mutex
+	thresholds  Thresholds
+	started     time.Time
+	initialized bool
+	last        map[string]time.Time
+	nowFn       func() time.Time
+}
+
+func NewTracker(thresholds Thresholds) *Tracker {
+	return &Tracker{
+		thresholds: thresholds,
+		started:    time.Now(),
+		last:       make(map[string]time.Time),
+		nowFn:      time.Now,
+	}
+}
+
+// SetThreshold changes how long activity may go without succeeding.
+func (t *Tracker) SetThreshold(activity string, threshold time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.thresholds[activity] = threshold
+}
+
+// Initialized records that the collector finished initializing.
+func (t *Tracker) Initialized() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.initialized = true
+}
+
+// Succeeded records a successful run of activity.
+func (t *Tracker) Succeeded(activity string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.last[activity] = t.nowFn()
+}
+
+// Status is a snapshot of the collector's health.
+type Status struct {
+	Initialized bool                 `json:"initialized"`
+	LastSuccess map[string]time.Time `json:"lastSuccess"`
+	// Stale lists the activities that have gone stale, and Problems
+	// describes them.
+	Stale    []string `json:"stale,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Status reports the tracker's current state. An activity that has never
+// succeeded is considered stale once its threshold has passed since the
+// tracker was created.
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.nowFn()
+	status := Status{
+		Initialized: t.initialized,
+		LastSuccess: make(map[string]time.Time, len(t.last)),
+	}
+
+	for activity, last := range t.last {
+		status.LastSuccess[activity] = last
+	}
+
+	for activity, threshold := range t.thresholds {
+		if threshold <= 0 {
+			continue
+		}
+
+		since := t.started
+		if last, present := t.last[activity]; present {
+			since = last
+		}
+
+		if age := now.Sub(since); age > threshold {
+			status.Stale = append(status.Stale, activity)
+			status.Problems = append(status.Problems,
+				fmt.Sprintf("no successful %s for %s (threshold %s)", activity, age.Round(time.Second), threshold))
+		}
+	}
+	sort.Strings(status.Stale)
+	sort.Strings(status.Problems)
+
+	return status
+}
+
+// Live reports whether the collector itself is making progress. It only fails
+// once scrapes are stale, so that a collector stuck failing gets restarted:
+// pushes and source refreshes depend on the API, and restarting the collector
+// while the API is down would only lose the data it holds.
+func (s Status) Live() bool {
+	for _, activity := range s.Stale {
+		if activity == Scrape {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Ready reports whether the collector is initialized and no activity is stale.
+func (s Status) Ready() bool {
+	return s.Initialized && len(s.Stale) == 0
+}
+
+// LivenessHandler serves /healthz.
+func (t *Tracker) LivenessHandler() http.Handler {
+	return t.handler(Status.Live)
+}
+
+// ReadinessHandler serves /readyz.
+func (t *Tracker) ReadinessHandler() http.Handler {
+	return t.handler(Status.Ready)
+}
+
+func (t *Tracker) handler(ok func(Status) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := t.Status()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok(status) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(status)
+	})
+}
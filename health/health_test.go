@@ -0,0 +1,85 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	start := time.Unix(10, 0)
+	now := start
+
+	tracker := NewTracker(Thresholds{
+		Scrape:         time.Minute,
+		Push:           10 * time.Minute,
+		RefreshSources: 0,
+	})
+	tracker.started = start
+	tracker.nowFn = func() time.Time { return now }
+
+	check := func(t *testing.T, live, ready bool) {
+		t.Helper()
+
+		for _, endpoint := range []struct {
+			handler  http.Handler
+			expected bool
+		}{
+			{tracker.LivenessHandler(), live},
+			{tracker.ReadinessHandler(), ready},
+		} {
+			w := httptest.NewRecorder()
+			endpoint.handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+			expectedCode := http.StatusOK
+			if !endpoint.expected {
+				expectedCode = http.StatusServiceUnavailable
+			}
+			if w.Code != expectedCode {
+				t.Fatalf("status code got: %d expected: %d body: %s", w.Code, expectedCode, w.Body.String())
+			}
+		}
+	}
+
+	// starting up: alive, but not ready
+	check(t, true, false)
+
+	tracker.Initialized()
+	tracker.Succeeded(Scrape)
+	check(t, true, true)
+
+	// scrapes keep failing
+	now = start.Add(2 * time.Minute)
+	check(t, false, false)
+	if problems := tracker.Status().Problems; len(problems) != 1 {
+		t.Fatal("unexpected problems:", problems)
+	}
+
+	tracker.Succeeded(Scrape)
+	check(t, true, true)
+
+	// pushes have never succeeded since startup: still alive, since
+	// restarting won't bring the API back
+	now = start.Add(11 * time.Minute)
+	tracker.Succeeded(Scrape)
+	check(t, true, false)
+	if stale := tracker.Status().Stale; len(stale) != 1 || stale[0] != Push {
+		t.Fatal("unexpected stale activities:", stale)
+	}
+
+	tracker.Succeeded(Push)
+	check(t, true, true)
+
+	// refreshing sources isn't checked
+	now = start.Add(24 * time.Hour)
+	tracker.Succeeded(Scrape)
+	tracker.Succeeded(Push)
+	check(t, true, true)
+
+	// scrapes that are only due every hour
+	tracker.SetThreshold(Scrape, time.Hour+time.Minute)
+	now = now.Add(time.Hour)
+	tracker.Succeeded(Push)
+	check(t, true, true)
+}
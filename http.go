@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/MindsightCo/collector/telemetry"
+	"github.com/pkg/errors"
+)
+
+// serveHTTP starts the collector's own HTTP listener in the background. It
+// serves the collector's metrics at /metrics, and liveness and readiness
+// checks at /healthz and /readyz.
+func (c *Config) serveHTTP() error {
+	listener, err := net.Listen("tcp", c.ListenAddress)
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", telemetry.Handler())
+	mux.Handle("/healthz", c.health.LivenessHandler())
+	mux.Handle("/readyz", c.health.ReadinessHandler())
+
+	c.server = &http.Server{Handler: mux}
+	go func() {
+		if err := c.server.Serve(listener); err != http.ErrServerClosed {
+			log.Println("WARNING (http):", err)
+		}
+	}()
+
+	log.Println("serving collector metrics on", listener.Addr())
+	return nil
+}
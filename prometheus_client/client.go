@@ -13,6 +13,18 @@ import (
 	prommodel "github.com/prometheus/common/model"
 )
 
+// ErrNoData is returned when a query succeeds but matches no series. It's a
+// legitimate outcome (e.g. an error rate query while there are no errors), not
+// a failure of the query or the server.
+var ErrNoData = errors.New("query returned no data")
+
+// IsBadQuery reports whether err is the prometheus server refusing a query as
+// invalid, e.g. because it can't parse it.
+func IsBadQuery(err error) bool {
+	apiErr, ok := errors.Cause(err).(*prometheus.Error)
+	return ok && apiErr.Type == prometheus.ErrBadData
+}
+
 // PromClient contains a connection to a prometheus server and allows query execution.
 type PromClient struct {
 	api   prometheus.API
@@ -21,8 +33,20 @@ type PromClient struct {
 
 // NewPromClient initializes a connection to a Prometheus server at the given url.
 func NewPromClient(url string) (*PromClient, error) {
+	return NewPromClientWithOptions(url, Options{})
+}
+
+// NewPromClientWithOptions initializes a connection to a Prometheus server at
+// the given url, authenticating as described by opts.
+func NewPromClientWithOptions(url string, opts Options) (*PromClient, error) {
+	transport, err := newRoundTripper(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "prometheus client transport")
+	}
+
 	client, err := promapi.NewClient(promapi.Config{
-		Address: url,
+		Address:      url,
+		RoundTripper: transport,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "new prometheus client connection")
@@ -35,7 +59,7 @@ func NewPromClient(url string) (*PromClient, error) {
 }
 
 // Query executes the given PromQL query and returns the resulting instant vector,
-// or an error if one occurred.
+// or an error if one occurred. ErrNoData is returned if the vector is empty.
 func (c *PromClient) Query(ctx context.Context, query string) (prommodel.Vector, error) {
 	result, _, err := c.api.Query(ctx, query, c.nowFn())
 	if err != nil {
@@ -49,8 +73,34 @@ func (c *PromClient) Query(ctx context.Context, query string) (prommodel.Vector,
 	v := result.(prommodel.Vector)
 
 	if len(v) == 0 {
-		return nil, errors.New("empty result vector")
+		return nil, ErrNoData
 	}
 
 	return v, nil
 }
+
+// QueryRange executes the given PromQL query over the range [start, end] at
+// the given step, and returns the resulting range vector, or an error if one
+// occurred. ErrNoData is returned if the matrix is empty.
+func (c *PromClient) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) (prommodel.Matrix, error) {
+	result, _, err := c.api.QueryRange(ctx, query, prometheus.Range{
+		Start: start,
+		End:   end,
+		Step:  step,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "execute prometheus range query")
+	}
+
+	if result.Type() != prommodel.ValMatrix {
+		return nil, errors.Errorf("expected matrix result type, got: %s", result.Type())
+	}
+
+	m := result.(prommodel.Matrix)
+
+	if len(m) == 0 {
+		return nil, ErrNoData
+	}
+
+	return m, nil
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/go-cmp/cmp"
+	prometheus "github.com/prometheus/client_golang/api/prometheus/v1"
 	prommodel "github.com/prometheus/common/model"
 )
 
@@ -53,3 +54,75 @@ func TestPrometheusClient(t *testing.T) {
 		t.Fatalf("invalid query result: %s", cmp.Diff(result, expectedResult))
 	}
 }
+
+func TestPrometheusClientRange(t *testing.T) {
+	testCtx := testContext(t)
+
+	expectedResult := prommodel.Matrix{
+		&prommodel.SampleStream{
+			Metric: prommodel.Metric{
+				"__name__": "fred",
+			},
+			Values: []prommodel.SamplePair{
+				{Timestamp: epoch, Value: prommodel.SampleValue(13.3)},
+				{Timestamp: epoch.Add(time.Minute), Value: prommodel.SampleValue(14.4)},
+			},
+		},
+	}
+
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	start, end := epoch.Time(), epoch.Time().Add(time.Minute)
+	promRange := prometheus.Range{Start: start, End: end, Step: time.Minute}
+
+	mockAPI := NewMockAPI(ctl)
+	mockAPI.EXPECT().QueryRange(testCtx, testQuery, promRange).Return(expectedResult, nil, nil)
+
+	promClient := &PromClient{api: mockAPI, nowFn: testTime}
+	result, err := promClient.QueryRange(testCtx, testQuery, start, end, time.Minute)
+	if err != nil {
+		t.Fatal("promclient execute range query:", err)
+	} else if !cmp.Equal(result, expectedResult) {
+		t.Fatalf("invalid range query result: %s", cmp.Diff(result, expectedResult))
+	}
+
+	mockAPI.EXPECT().QueryRange(testCtx, testQuery, promRange).Return(prommodel.Vector{}, nil, nil)
+	if _, err := promClient.QueryRange(testCtx, testQuery, start, end, time.Minute); err == nil {
+		t.Fatal("expected an error for a non-matrix result")
+	}
+}
+
+func TestPrometheusClientNoData(t *testing.T) {
+	testCtx := testContext(t)
+
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	mockAPI := NewMockAPI(ctl)
+	mockAPI.EXPECT().Query(testCtx, testQuery, epoch.Time()).Return(prommodel.Vector{}, nil, nil)
+
+	promClient := &PromClient{api: mockAPI, nowFn: testTime}
+	if _, err := promClient.Query(testCtx, testQuery); err != ErrNoData {
+		t.Fatal("expected ErrNoData for an empty vector, got:", err)
+	}
+}
+
+func TestPrometheusClientBadQuery(t *testing.T) {
+	testCtx := testContext(t)
+
+	ctl := gomock.NewController(t)
+	defer ctl.Finish()
+
+	mockAPI := NewMockAPI(ctl)
+	mockAPI.EXPECT().Query(testCtx, testQuery, epoch.Time()).Return(nil, nil, &prometheus.Error{Type: prometheus.ErrBadData, Msg: "parse error"})
+	mockAPI.EXPECT().Query(testCtx, testQuery, epoch.Time()).Return(nil, nil, &prometheus.Error{Type: prometheus.ErrServer, Msg: "server error: 503"})
+
+	promClient := &PromClient{api: mockAPI, nowFn: testTime}
+	if _, err := promClient.Query(testCtx, testQuery); !IsBadQuery(err) {
+		t.Fatal("expected a bad query error, got:", err)
+	}
+	if _, err := promClient.Query(testCtx, testQuery); err == nil || IsBadQuery(err) {
+		t.Fatal("expected a server error, got:", err)
+	}
+}
@@ -0,0 +1,181 @@
+package promclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Options describes how to authenticate to a Prometheus server (or a
+// compatible gateway such as Thanos Query, Cortex or Mimir). The zero value
+// connects without authentication, using the system's CAs.
+type Options struct {
+	BasicAuth *BasicAuth `mapstructure:"basic_auth"`
+	// BearerToken, or the contents of BearerTokenFile, is sent in the
+	// Authorization header. The file is re-read for every request so
+	// rotated tokens are picked up.
+	BearerToken     string     `mapstructure:"bearer_token"`
+	BearerTokenFile string     `mapstructure:"bearer_token_file"`
+	TLS             TLSOptions `mapstructure:"tls"`
+	// Headers are added to every request, e.g. X-Scope-OrgID.
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// BasicAuth holds HTTP basic auth credentials. PasswordFile, if given, is
+// read for every request instead of using Password.
+type BasicAuth struct {
+	Username     string `mapstructure:"username"`
+	Password     string `mapstructure:"password"`
+	PasswordFile string `mapstructure:"password_file"`
+}
+
+// TLSOptions configures the TLS connection to the server.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of CAs trusted in addition to the system's.
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile hold a client certificate for mutual TLS.
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+func (o Options) validate() error {
+	if o.BasicAuth != nil && o.BasicAuth.Password != "" && o.BasicAuth.PasswordFile != "" {
+		return errors.New("at most one of basic auth password and password_file may be given")
+	}
+	if o.BearerToken != "" && o.BearerTokenFile != "" {
+		return errors.New("at most one of bearer_token and bearer_token_file may be given")
+	}
+	if o.BasicAuth != nil && (o.BearerToken != "" || o.BearerTokenFile != "") {
+		return errors.New("basic auth and bearer token are mutually exclusive")
+	}
+	if (o.TLS.CertFile == "") != (o.TLS.KeyFile == "") {
+		return errors.New("tls cert_file and key_file must be given together")
+	}
+
+	return nil
+}
+
+// newRoundTripper builds the transport for a client with the given options.
+func newRoundTripper(opts Options) (http.RoundTripper, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newTLSConfig(opts.TLS)
+	if err != nil {
+		return nil, errors.Wrap(err, "tls config")
+	}
+
+	// same settings as the prometheus client's default transport
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+
+	if opts.BasicAuth != nil || opts.BearerToken != "" || opts.BearerTokenFile != "" || len(opts.Headers) > 0 {
+		transport = &authRoundTripper{opts: opts, next: transport}
+	}
+
+	return transport, nil
+}
+
+func newTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read ca file")
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in ca file %s", opts.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// authRoundTripper adds credentials and extra headers to every request.
+type authRoundTripper struct {
+	opts Options
+	next http.RoundTripper
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the caller's request
+	out := new(http.Request)
+	*out = *req
+	out.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		out.Header[k] = append([]string(nil), v...)
+	}
+
+	for k, v := range rt.opts.Headers {
+		out.Header.Set(k, v)
+	}
+
+	if auth := rt.opts.BasicAuth; auth != nil {
+		password := auth.Password
+		if auth.PasswordFile != "" {
+			secret, err := readSecret(auth.PasswordFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "read basic auth password file")
+			}
+			password = secret
+		}
+		out.SetBasicAuth(auth.Username, password)
+	}
+
+	token := rt.opts.BearerToken
+	if rt.opts.BearerTokenFile != "" {
+		secret, err := readSecret(rt.opts.BearerTokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read bearer token file")
+		}
+		token = secret
+	}
+	if token != "" {
+		out.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return rt.next.RoundTrip(out)
+}
+
+func readSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,135 @@
+package promclient
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const vectorResponse = `{
+	"status": "success",
+	"data": {
+		"resultType": "vector",
+		"result": [{"metric": {"__name__": "up"}, "value": [10, "1"]}]
+	}
+}`
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal("write test file:", err)
+	}
+
+	return path
+}
+
+func TestConnectionOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promclient-test")
+	if err != nil {
+		t.Fatal("create temp dir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cases = []struct {
+		name    string
+		opts    Options
+		check   func(t *testing.T, r *http.Request)
+		setupFn func(opts *Options, server *httptest.Server)
+	}{
+		{
+			name: "basic auth with a password file",
+			opts: Options{
+				BasicAuth: &BasicAuth{
+					Username:     "joeblow",
+					PasswordFile: writeTestFile(t, dir, "password", []byte("s3cret\n")),
+				},
+				TLS: TLSOptions{InsecureSkipVerify: true},
+			},
+			check: func(t *testing.T, r *http.Request) {
+				user, password, ok := r.BasicAuth()
+				if !ok || user != "joeblow" || password != "s3cret" {
+					t.Errorf("unexpected basic auth: %s %s %t", user, password, ok)
+				}
+			},
+		},
+		{
+			name: "bearer token file and extra headers",
+			opts: Options{
+				BearerTokenFile: writeTestFile(t, dir, "token", []byte("a-token")),
+				Headers:         map[string]string{"X-Scope-OrgID": "tenant-1"},
+				TLS:             TLSOptions{InsecureSkipVerify: true},
+			},
+			check: func(t *testing.T, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer a-token" {
+					t.Errorf("unexpected authorization header: %s", r.Header.Get("Authorization"))
+				}
+				if r.Header.Get("X-Scope-OrgID") != "tenant-1" {
+					t.Errorf("unexpected org id header: %s", r.Header.Get("X-Scope-OrgID"))
+				}
+			},
+		},
+		{
+			name: "insecure skip verify",
+			opts: Options{TLS: TLSOptions{InsecureSkipVerify: true}},
+		},
+		{
+			name: "custom ca bundle",
+			setupFn: func(opts *Options, server *httptest.Server) {
+				caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+				opts.TLS.CAFile = writeTestFile(t, dir, "ca.pem", caPEM)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.check != nil {
+					tc.check(t, r)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(vectorResponse))
+			}))
+			defer server.Close()
+
+			opts := tc.opts
+			if tc.setupFn != nil {
+				tc.setupFn(&opts, server)
+			}
+
+			client, err := NewPromClientWithOptions(server.URL, opts)
+			if err != nil {
+				t.Fatal("new prometheus client:", err)
+			}
+
+			result, err := client.Query(testContext(t), testQuery)
+			if err != nil {
+				t.Fatal("query:", err)
+			}
+			if len(result) != 1 {
+				t.Fatal("unexpected query result:", result)
+			}
+		})
+	}
+}
+
+func TestConnectionOptionsValidation(t *testing.T) {
+	invalid := []Options{
+		{BearerToken: "a", BearerTokenFile: "b"},
+		{BasicAuth: &BasicAuth{Username: "u"}, BearerToken: "a"},
+		{TLS: TLSOptions{CertFile: "cert.pem"}},
+		{TLS: TLSOptions{CAFile: "/does/not/exist"}},
+	}
+
+	for _, opts := range invalid {
+		if _, err := NewPromClientWithOptions("http://localhost:9090", opts); err == nil {
+			t.Errorf("expected options to be rejected: %+v", opts)
+		}
+	}
+}
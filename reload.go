@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// liveKeys are the config keys a reload applies to the running collector.
+// Changes to any other key only take effect after a restart.
+var liveKeys = map[string]bool{
+	"sources":                  true,
+	"sources_dir":              true,
+	"source_precedence":        true,
+	"client_id":                true,
+	"client_secret":            true,
+	"scrape_interval":          true,
+	"query_timeout":            true,
+	"refresh_sources_interval": true,
+	"subscribe_retry_interval": true,
+}
+
+// watchConfig requests a reload whenever the config file changes, until ctx is
+// done. Files in the sources directory aren't watched, a reload can be
+// requested with SIGHUP after changing them.
+//
+// viper.WatchConfig isn't used: it re-reads the file on its own goroutine,
+// racing with reload. Here the file is only ever read by reload, on Loop's
+// goroutine.
+func (c *Config) watchConfig(ctx context.Context) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return
+	}
+	file = filepath.Clean(file)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("WARNING (reload): can't watch the config file:", err)
+		return
+	}
+	// the directory is watched, since editors and config maps replace the
+	// file rather than write to it
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		log.Println("WARNING (reload): can't watch the config file:", err)
+		watcher.Close()
+		return
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		realFile, _ := filepath.EvalSymlinks(file)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// a symlinked file changes when its target is swapped
+				nextReal, _ := filepath.EvalSymlinks(file)
+				changed := filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				if changed || (nextReal != "" && nextReal != realFile) {
+					realFile = nextReal
+					log.Println("config file changed, reloading")
+					c.requestReload()
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("WARNING (reload): watching the config file:", err)
+			}
+		}
+	}()
+}
+
+// requestReload has Loop reload the configuration. Requests made while one is
+// already pending are merged into it.
+func (c *Config) requestReload() {
+	select {
+	case c.reloads <- struct{}{}:
+	default:
+	}
+}
+
+// reload re-reads and checks the configuration, then applies it to the running
+// collector. Nothing is changed if the new configuration is invalid, including
+// settings validate finds out of range, or if its sources or credentials can't
+// be used.
+func (c *Config) reload(ctx context.Context) error {
+	if err := viper.ReadInConfig(); err != nil {
+		return errors.Wrap(err, "read config file")
+	}
+
+	next, err := decodeConfig(false)
+	if err != nil {
+		return err
+	}
+	// the same checks as validate's: a setting out of range could, say,
+	// have the collector scrape or poll the API in a busy loop
+	if err := next.settingsError(); err != nil {
+		return errors.Wrap(err, "settings")
+	}
+
+	if keys := restartKeys(c, next); len(keys) > 0 {
+		log.Println("WARNING (reload): restart to apply changes to:", strings.Join(keys, ", "))
+	}
+
+	// the new credentials are checked before anything is changed
+	var grant *grantAuth
+	if c.auth != nil && (next.ClientID != c.ClientID || next.ClientSecret != c.ClientSecret) {
+		grant = newGrantAuth(auth0TokenURL, next.credentialsRequest())
+		if c.SourceMode != sourceModeLocal {
+			if _, err := grant.GetAccessToken(); err != nil {
+				return errors.Wrap(err, "testing new credentials")
+			}
+		}
+	}
+
+	sources, dir, precedence := c.Sources, c.SourcesDir, c.SourcePrecedence
+	c.Sources, c.SourcesDir, c.SourcePrecedence = next.Sources, next.SourcesDir, next.SourcePrecedence
+	data, err := c.replaceSources(c.apiSources)
+	if err != nil {
+		c.Sources, c.SourcesDir, c.SourcePrecedence = sources, dir, precedence
+		return err
+	}
+
+	if grant != nil {
+		c.auth.replace(grant)
+		log.Println("credentials changed, using the new ones")
+	}
+	c.ClientID, c.ClientSecret = next.ClientID, next.ClientSecret
+
+	c.ScrapeInterval = next.ScrapeInterval
+	c.QueryTimeout = next.QueryTimeout
+	c.RefreshSourcesInterval = next.RefreshSourcesInterval
+	c.SubscribeRetryInterval = next.SubscribeRetryInterval
+	c.cache.SetSchedule(c.ScrapeInterval, c.QueryTimeout)
+	c.setScrapeThreshold()
+
+	log.Println("config reloaded")
+
+	// the data of removed sources isn't a reason to reject the new config
+	if err := c.push(ctx, data); err != nil {
+		log.Println("WARNING (reload): push after changing sources:", err)
+	}
+
+	return nil
+}
+
+// restartKeys lists the config keys that differ between old and next, but
+// can't be changed while running.
+func restartKeys(old, next *Config) []string {
+	var keys []string
+
+	oldValue, nextValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.PkgPath != "" {
+			// unexported, not configuration
+			continue
+		}
+
+		key := field.Tag.Get("mapstructure")
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+		if liveKeys[key] {
+			continue
+		}
+
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// resetTimer makes t fire after d, whether or not it's fired and been
+// drained already.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MindsightCo/collector/cache"
+	"github.com/MindsightCo/collector/health"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/spf13/viper"
+)
+
+const reloadSources = `
+sinks:
+  - type: stdout
+sources:
+  - id: 1
+    sourceURL: http://prometheus:9090
+    query: sum(up)
+`
+
+const reloadSettings = `
+source_mode: local
+scrape_interval: 10s
+`
+
+// runningConfig reads the config file at path, and sets up what reload needs
+// of a running collector.
+func runningConfig(t *testing.T, path string) *Config {
+	t.Helper()
+
+	viper.Reset()
+	viper.SetConfigFile(path)
+
+	c, err := ReadConfig()
+	if err != nil {
+		t.Fatal("read config:", err)
+	}
+
+	c.health = health.NewTracker(health.Thresholds{})
+	c.cache, err = cache.NewCache(nil, c.CacheDepth, c.CacheAge)
+	if err != nil {
+		t.Fatal("new cache:", err)
+	}
+	if _, err := c.replaceSources(nil); err != nil {
+		t.Fatal("set sources:", err)
+	}
+
+	return c
+}
+
+func writeConfig(t *testing.T, path, config string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal("write config:", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer viper.Reset()
+
+	dir, err := ioutil.TempDir("", "reload-test")
+	if err != nil {
+		t.Fatal("create temp dir:", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mindsight-agent.yaml")
+
+	var cases = []struct {
+		name           string
+		settings       string
+		sources        string
+		expectErr      bool
+		scrapeInterval time.Duration
+		sourceQueries  []string
+	}{
+		{
+			name:     "applied",
+			settings: "source_mode: local\nscrape_interval: 30s\n",
+			sources: `
+  - id: 2
+    sourceURL: http://prometheus:9090
+    query: sum(rate(errors_total[5m]))
+`,
+			scrapeInterval: time.Second * 30,
+			sourceQueries:  []string{"sum(up)", "sum(rate(errors_total[5m]))"},
+		},
+		{
+			name:           "zero scrape interval",
+			settings:       "source_mode: local\nscrape_interval: 0s\n",
+			expectErr:      true,
+			scrapeInterval: time.Second * 10,
+			sourceQueries:  []string{"sum(up)"},
+		},
+		{
+			name:           "negative refresh interval",
+			settings:       "source_mode: merged\nclient_id: id\nclient_secret: secret\nscrape_interval: 10s\nrefresh_sources_interval: -1m\n",
+			expectErr:      true,
+			scrapeInterval: time.Second * 10,
+			sourceQueries:  []string{"sum(up)"},
+		},
+		{
+			// connection profiles only change on restart, so the new
+			// source can't be scheduled: everything is rolled back
+			name: "sources rolled back",
+			settings: `
+source_mode: local
+scrape_interval: 30s
+connections:
+  thanos:
+    url: http://thanos:10902
+`,
+			sources: `
+  - id: 2
+    sourceURL: http://thanos:10902
+    query: sum(up)
+    connection: thanos
+`,
+			expectErr:      true,
+			scrapeInterval: time.Second * 10,
+			sourceQueries:  []string{"sum(up)"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			writeConfig(t, path, reloadSettings+reloadSources)
+			c := runningConfig(t, path)
+
+			writeConfig(t, path, tc.settings+reloadSources+tc.sources)
+			err := c.reload(context.Background())
+			if tc.expectErr != (err != nil) {
+				t.Fatal("unexpected reload result:", err)
+			}
+
+			if c.ScrapeInterval != tc.scrapeInterval {
+				t.Fatalf("scrape interval got: %s expected: %s", c.ScrapeInterval, tc.scrapeInterval)
+			}
+
+			var queries []string
+			for _, src := range c.Sources {
+				queries = append(queries, src.Query)
+			}
+			if !cmp.Equal(tc.sourceQueries, queries) {
+				t.Fatal("unexpected local sources:", cmp.Diff(tc.sourceQueries, queries))
+			}
+			if stats := c.cache.Stats(); stats.Sources != len(tc.sourceQueries) {
+				t.Fatal("unexpected number of cached sources:", stats.Sources)
+			}
+		})
+	}
+}
+
+func TestRestartKeys(t *testing.T) {
+	old := &Config{
+		Sources:        []cache.Source{{SourceID: 1, Query: "sum(up)"}},
+		ScrapeInterval: time.Second * 10,
+		CacheDepth:     1000,
+		SpoolDir:       "/var/spool/mindsight",
+		ClientID:       "id",
+	}
+	next := &Config{
+		Sources:        []cache.Source{{SourceID: 2, Query: "sum(up)"}},
+		ScrapeInterval: time.Second * 30,
+		CacheDepth:     500,
+		SpoolDir:       "/var/lib/mindsight",
+		ClientID:       "other-id",
+		apiSources:     []cache.Source{{SourceID: 3}},
+	}
+
+	expected := []string{"cache_depth", "spool_dir"}
+	if got := restartKeys(old, next); !cmp.Equal(expected, got, cmpopts.SortSlices(func(a, b string) bool { return a < b })) {
+		t.Fatal("unexpected restart keys:", cmp.Diff(expected, got))
+	}
+}
@@ -0,0 +1,242 @@
+// package sink delivers flushed batches of metrics to one or more outputs.
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MindsightCo/collector/apiclient"
+	"github.com/MindsightCo/collector/telemetry"
+	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// Sink is an output for flushed batches of metrics. *apiclient.MetricsPusher
+// is a Sink.
+type Sink interface {
+	Push(ctx context.Context, data map[int]prommodel.Vector) error
+}
+
+// SequencedSink is a Sink that can tell the receiving end which batch it is
+// pushing, so a batch pushed more than once can be deduplicated.
+type SequencedSink interface {
+	Sink
+	PushBatch(ctx context.Context, seq uint64, data map[int]prommodel.Vector) error
+}
+
+// Stats counts the pushes made to one sink.
+type Stats struct {
+	Pushes    int
+	Failures  int
+	LastError error
+}
+
+// Error is returned by Fanout.Push when some sinks failed to take a batch.
+type Error struct {
+	// Failures holds the error of every failed sink, by name.
+	Failures map[string]error
+	NSinks   int
+}
+
+func (e *Error) Error() string {
+	names := make([]string, 0, len(e.Failures))
+	for name := range e.Failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, e.Failures[name]))
+	}
+
+	return fmt.Sprintf("push failed for %d of %d sinks: %s", len(e.Failures), e.NSinks, strings.Join(msgs, "; "))
+}
+
+// pending remembers which sinks already took a batch that has to be pushed
+// again because other sinks failed. Batches are identified by their sequence
+// number, or by a fingerprint of their content if they have none.
+type pending struct {
+	key  uint64
+	done map[string]bool
+}
+
+// Fanout pushes every batch to all of its sinks. It is safe for concurrent
+// use, but sinks must be added before the first push.
+type Fanout struct {
+	names []string
+	sinks map[string]Sink
+
+	mu      sync.Mutex
+	stats   map[string]*Stats
+	pending *pending
+}
+
+func NewFanout() *Fanout {
+	return &Fanout{
+		sinks: make(map[string]Sink),
+		stats: make(map[string]*Stats),
+	}
+}
+
+// Add registers a sink under a unique name, which identifies it in logs,
+// errors and metrics.
+func (f *Fanout) Add(name string, s Sink) error {
+	if _, exists := f.sinks[name]; exists {
+		return errors.Errorf("duplicate sink name: %s", name)
+	}
+
+	f.names = append(f.names, name)
+	f.sinks[name] = s
+	f.stats[name] = &Stats{}
+	return nil
+}
+
+// Names returns the names of the sinks, in the order they were added.
+func (f *Fanout) Names() []string {
+	return append([]string(nil), f.names...)
+}
+
+// Push sends data that isn't part of a sequenced batch, see PushBatch.
+func (f *Fanout) Push(ctx context.Context, data map[int]prommodel.Vector) error {
+	return f.PushBatch(ctx, 0, data)
+}
+
+// PushBatch sends data to every sink concurrently, passing seq on to
+// sequenced sinks. A sink that rejects the batch's content permanently (see
+// apiclient.IsPermanent) is given up on, the batch is dropped for that sink
+// only. Every other failure, such as a sink that can't be reached or refuses
+// the credentials, is returned in an *Error holding just those sinks, and the
+// caller is expected to push the same batch again: sinks that already took it
+// are then skipped, so they don't receive it twice.
+func (f *Fanout) PushBatch(ctx context.Context, seq uint64, data map[int]prommodel.Vector) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := seq
+	done := make(map[string]bool)
+	if f.pending != nil {
+		if key == 0 {
+			key = batchFingerprint(data)
+		}
+		if key == f.pending.key {
+			done = f.pending.done
+		}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		errsMu  sync.Mutex
+		errs    = make(map[string]error)
+		pushing []string
+	)
+	for _, name := range f.names {
+		if done[name] {
+			continue
+		}
+		pushing = append(pushing, name)
+
+		wg.Add(1)
+		go func(name string, s Sink) {
+			defer wg.Done()
+
+			var err error
+			if sequenced, ok := s.(SequencedSink); ok {
+				err = sequenced.PushBatch(ctx, seq, data)
+			} else {
+				err = s.Push(ctx, data)
+			}
+			if err != nil {
+				errsMu.Lock()
+				errs[name] = err
+				errsMu.Unlock()
+			}
+		}(name, f.sinks[name])
+	}
+	wg.Wait()
+
+	failures := make(map[string]error)
+	for _, name := range pushing {
+		stats := f.stats[name]
+		stats.Pushes++
+
+		err, failed := errs[name]
+		if !failed {
+			telemetry.SinkPushes.WithLabelValues(name, "success").Inc()
+			done[name] = true
+			continue
+		}
+
+		telemetry.SinkPushes.WithLabelValues(name, "failure").Inc()
+		stats.Failures++
+		stats.LastError = err
+
+		if apiclient.IsPermanent(err) {
+			log.Printf("WARNING (sink %s): dropping rejected batch: %v\n", name, err)
+			done[name] = true
+			continue
+		}
+		failures[name] = err
+	}
+
+	if len(failures) == 0 {
+		f.pending = nil
+		return nil
+	}
+
+	if key == 0 {
+		key = batchFingerprint(data)
+	}
+	f.pending = &pending{key: key, done: done}
+
+	return &Error{Failures: failures, NSinks: len(f.names)}
+}
+
+// Stats returns a snapshot of each sink's push counts, by name.
+func (f *Fanout) Stats() map[string]Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stats := make(map[string]Stats, len(f.stats))
+	for name, s := range f.stats {
+		stats[name] = *s
+	}
+
+	return stats
+}
+
+// Close closes every sink that holds resources, such as an open file.
+func (f *Fanout) Close() error {
+	var firstErr error
+	for _, name := range f.names {
+		closer, ok := f.sinks[name].(io.Closer)
+		if !ok {
+			continue
+		}
+
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "close sink %s", name)
+		}
+	}
+
+	return firstErr
+}
+
+// batchFingerprint identifies a batch by its content. encoding/json sorts map
+// keys, so equal batches always hash the same.
+func batchFingerprint(data map[int]prommodel.Vector) uint64 {
+	h := fnv.New64a()
+	json.NewEncoder(h).Encode(data)
+	return h.Sum64()
+}
@@ -0,0 +1,254 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/MindsightCo/collector/apiclient"
+	"github.com/MindsightCo/collector/spool"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+)
+
+func testBatch(id int, value float64) map[int]prommodel.Vector {
+	return map[int]prommodel.Vector{
+		id: prommodel.Vector{
+			&prommodel.Sample{
+				Timestamp: prommodel.TimeFromUnix(10),
+				Value:     prommodel.SampleValue(value),
+				Metric: prommodel.Metric{
+					"__name__": "joeblow",
+				},
+			},
+		},
+	}
+}
+
+// recordingSink keeps every batch pushed to it, and fails while err is set.
+type recordingSink struct {
+	batches []map[int]prommodel.Vector
+	err     error
+}
+
+func (s *recordingSink) Push(ctx context.Context, data map[int]prommodel.Vector) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.batches = append(s.batches, data)
+	return nil
+}
+
+func TestFanout(t *testing.T) {
+	good := &recordingSink{}
+	flaky := &recordingSink{err: errors.New("connection reset")}
+
+	f := NewFanout()
+	f.Add("good", good)
+	f.Add("flaky", flaky)
+
+	if err := f.Add("good", &recordingSink{}); err == nil {
+		t.Fatal("expected an error adding a duplicate sink name")
+	}
+
+	batch := testBatch(1, 1.1)
+	err := f.Push(context.Background(), batch)
+	fanoutErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected a *sink.Error, got: %#v", err)
+	}
+	if _, failed := fanoutErr.Failures["flaky"]; !failed || len(fanoutErr.Failures) != 1 {
+		t.Fatal("unexpected failures:", fanoutErr.Failures)
+	}
+
+	// the retry only goes to the sink that failed
+	flaky.err = nil
+	if err := f.Push(context.Background(), batch); err != nil {
+		t.Fatal("retry push:", err)
+	}
+
+	expected := []map[int]prommodel.Vector{batch}
+	if !cmp.Equal(expected, good.batches) {
+		t.Fatal("unexpected batches in good sink:", cmp.Diff(expected, good.batches))
+	}
+	if !cmp.Equal(expected, flaky.batches) {
+		t.Fatal("unexpected batches in flaky sink:", cmp.Diff(expected, flaky.batches))
+	}
+
+	// a new batch goes everywhere again
+	next := testBatch(2, 2.2)
+	if err := f.Push(context.Background(), next); err != nil {
+		t.Fatal("push:", err)
+	}
+	if len(good.batches) != 2 || len(flaky.batches) != 2 {
+		t.Fatal("new batch was not pushed to every sink:", len(good.batches), len(flaky.batches))
+	}
+
+	stats := f.Stats()
+	if stats["good"].Pushes != 2 || stats["good"].Failures != 0 {
+		t.Fatalf("unexpected stats for good sink: %+v", stats["good"])
+	}
+	if stats["flaky"].Pushes != 3 || stats["flaky"].Failures != 1 || stats["flaky"].LastError == nil {
+		t.Fatalf("unexpected stats for flaky sink: %+v", stats["flaky"])
+	}
+}
+
+func TestFanoutSequencedRetry(t *testing.T) {
+	good := &recordingSink{}
+	flaky := &recordingSink{err: errors.New("connection reset")}
+
+	f := NewFanout()
+	f.Add("good", good)
+	f.Add("flaky", flaky)
+
+	f.PushBatch(context.Background(), 3, testBatch(1, 1.1))
+
+	// the sequence number identifies the batch being retried, whatever its
+	// content
+	flaky.err = nil
+	if err := f.PushBatch(context.Background(), 3, testBatch(1, 1.1)); err != nil {
+		t.Fatal("retry push:", err)
+	}
+	if len(good.batches) != 1 || len(flaky.batches) != 1 {
+		t.Fatal("retried batch was not pushed once to every sink:", len(good.batches), len(flaky.batches))
+	}
+
+	if err := f.PushBatch(context.Background(), 4, testBatch(1, 1.1)); err != nil {
+		t.Fatal("push:", err)
+	}
+	if len(good.batches) != 2 || len(flaky.batches) != 2 {
+		t.Fatal("a new batch with the same content was not pushed to every sink")
+	}
+}
+
+func TestFanoutPermanentFailure(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Token")
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	webhook, err := apiclient.NewMetricsPusher(server.URL, nil,
+		apiclient.WithEndpoint(server.URL),
+		apiclient.WithHeaders(map[string]string{"X-Token": "sekret"}))
+	if err != nil {
+		t.Fatal("create pusher:", err)
+	}
+
+	good := &recordingSink{}
+	f := NewFanout()
+	f.Add("webhook", webhook)
+	f.Add("good", good)
+
+	if err := f.Push(context.Background(), testBatch(1, 1.1)); err != nil {
+		t.Fatal("a permanently rejected batch should be dropped for that sink:", err)
+	}
+	if header != "sekret" {
+		t.Fatal("webhook header was not sent, got:", header)
+	}
+	if len(good.batches) != 1 {
+		t.Fatal("batch was not pushed to the good sink")
+	}
+	if stats := f.Stats()["webhook"]; stats.Failures != 1 {
+		t.Fatalf("permanent failure was not counted: %+v", stats)
+	}
+}
+
+func TestFanoutSpoolAuthFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink-test")
+	if err != nil {
+		t.Fatal("create temp dir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	status := int32(http.StatusUnauthorized)
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(atomic.LoadInt32(&status)); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	pusher, err := apiclient.NewMetricsPusher(server.URL, nil, apiclient.WithEndpoint(server.URL))
+	if err != nil {
+		t.Fatal("create pusher:", err)
+	}
+	f := NewFanout()
+	f.Add("mindsight", pusher)
+
+	s, err := spool.Open(dir, spool.Options{})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+	defer s.Close()
+	for i := 1; i <= 3; i++ {
+		s.Append(uint64(i), testBatch(i, float64(i)))
+	}
+
+	// refused credentials stop the drain and keep every batch
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		atomic.StoreInt32(&status, int32(code))
+		if err := s.Drain(context.Background(), 0, f.PushBatch); err == nil {
+			t.Fatalf("expected drain to stop on status %d", code)
+		}
+		if !s.Pending() {
+			t.Fatalf("batches were dropped on status %d", code)
+		}
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := s.Drain(context.Background(), 0, f.PushBatch); err != nil {
+		t.Fatal("drain with valid credentials:", err)
+	}
+	if n := atomic.LoadInt32(&received); n != 3 {
+		t.Fatal("unexpected number of batches received:", n)
+	}
+
+	// a rejected batch is dropped, so it can't block the ones after it
+	atomic.StoreInt32(&status, http.StatusUnprocessableEntity)
+	s.Append(4, testBatch(4, 4))
+	if err := s.Drain(context.Background(), 0, f.PushBatch); err != nil {
+		t.Fatal("drain of a rejected batch:", err)
+	}
+	if s.Pending() {
+		t.Fatal("rejected batch was kept")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	batches := []map[int]prommodel.Vector{testBatch(1, 1.1), testBatch(2, 2.2)}
+	for _, batch := range batches {
+		if err := w.Push(context.Background(), batch); err != nil {
+			t.Fatal("push:", err)
+		}
+	}
+
+	var got []map[int]prommodel.Vector
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var batch map[int]prommodel.Vector
+		if err := dec.Decode(&batch); err != nil {
+			t.Fatal("decode line:", err)
+		}
+		got = append(got, batch)
+	}
+
+	if !cmp.Equal(batches, got) {
+		t.Fatal("unexpected written batches:", cmp.Diff(batches, got))
+	}
+}
@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// Writer is a sink that writes each batch as a line of JSON, in the same
+// format the Mindsight API receives.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// NewStdout returns a Writer for the process' standard output.
+func NewStdout() *Writer {
+	return NewWriter(os.Stdout)
+}
+
+// NewFile returns a Writer that appends to the file at path, creating it if
+// needed.
+func NewFile(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open sink file")
+	}
+
+	return &Writer{w: f, closer: f}, nil
+}
+
+func (w *Writer) Push(ctx context.Context, data map[int]prommodel.Vector) error {
+	line, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "encode metrics")
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.w.Write(line); err != nil {
+		return errors.Wrap(err, "write metrics")
+	}
+
+	return nil
+}
+
+func (w *Writer) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+
+	return w.closer.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/MindsightCo/collector/apiclient"
+	"github.com/MindsightCo/collector/sink"
+	"github.com/pkg/errors"
+)
+
+// Sink types.
+const (
+	sinkMindsight   = "mindsight"
+	sinkFile        = "file"
+	sinkStdout      = "stdout"
+	sinkRemoteWrite = "remote_write"
+	sinkWebhook     = "webhook"
+)
+
+// SinkConfig configures one output for flushed metrics. Name defaults to
+// Type, so it only needs to be set when several sinks share a type.
+type SinkConfig struct {
+	Name string
+	Type string
+	// Path is the file written by a file sink.
+	Path string
+	// URL is where remote_write and webhook sinks send their requests, with
+	// any extra Headers.
+	URL     string
+	Headers map[string]string
+}
+
+var defaultSinks = []SinkConfig{{Type: sinkMindsight}}
+
+// sinkNames describes the configured sinks for logging.
+func (c *Config) sinkNames() string {
+	names := make([]string, 0, len(c.Sinks))
+	for _, sc := range c.Sinks {
+		name := sc.Name
+		if name == "" {
+			name = sc.Type
+		}
+		names = append(names, name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// initSinks builds the fan-out every flushed batch is pushed through.
+func (c *Config) initSinks(retry apiclient.RetryPolicy) (*sink.Fanout, error) {
+	fanout := sink.NewFanout()
+
+	for _, sc := range c.Sinks {
+		s, err := c.newSink(sc, retry)
+		if err != nil {
+			fanout.Close()
+			return nil, errors.Wrapf(err, "sink %s", sc.Type)
+		}
+
+		name := sc.Name
+		if name == "" {
+			name = sc.Type
+		}
+		if err := fanout.Add(name, s); err != nil {
+			fanout.Close()
+			return nil, errors.Wrap(err, "set name to tell sinks of the same type apart")
+		}
+	}
+
+	return fanout, nil
+}
+
+func (c *Config) newSink(sc SinkConfig, retry apiclient.RetryPolicy) (sink.Sink, error) {
+	switch sc.Type {
+	case sinkMindsight:
+		encoder, err := apiclient.NewEncoder(c.PushFormat)
+		if err != nil {
+			return nil, errors.Wrap(err, "init push encoder")
+		}
+
+		return apiclient.NewMetricsPusher(c.APIServer, c.auth,
+			apiclient.WithRetryPolicy(retry),
+			apiclient.WithEncoder(encoder),
+			apiclient.WithBatchLimits(c.PushMaxBytes, c.PushMaxSamples),
+			apiclient.WithInstanceID(c.seq.InstanceID),
+			apiclient.WithCompression(c.PushCompression, c.PushCompressionLevel))
+
+	case sinkFile:
+		if sc.Path == "" {
+			return nil, errors.New("path must be given")
+		}
+		return sink.NewFile(sc.Path)
+
+	case sinkStdout:
+		return sink.NewStdout(), nil
+
+	case sinkRemoteWrite, sinkWebhook:
+		if sc.URL == "" {
+			return nil, errors.New("url must be given")
+		}
+
+		format := apiclient.FormatJSON
+		if sc.Type == sinkRemoteWrite {
+			format = apiclient.FormatRemoteWrite
+		}
+		encoder, err := apiclient.NewEncoder(format)
+		if err != nil {
+			return nil, err
+		}
+
+		return apiclient.NewMetricsPusher(sc.URL, nil,
+			apiclient.WithEndpoint(sc.URL),
+			apiclient.WithRetryPolicy(retry),
+			apiclient.WithEncoder(encoder),
+			apiclient.WithBatchLimits(c.PushMaxBytes, c.PushMaxSamples),
+			apiclient.WithInstanceID(c.seq.InstanceID),
+			apiclient.WithHeaders(sc.Headers))
+	}
+
+	return nil, errors.Errorf("unsupported sink type: %q", sc.Type)
+}
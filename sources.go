@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+
+	"github.com/MindsightCo/collector/cache"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Source modes: where the collector's sources come from.
+const (
+	// sourceModeAPI takes sources from the Mindsight API only.
+	sourceModeAPI = "api"
+	// sourceModeLocal takes sources from the configuration only, so the
+	// collector never needs to reach the API for them.
+	sourceModeLocal = "local"
+	// sourceModeMerged runs both the local sources and the API's.
+	sourceModeMerged = "merged"
+)
+
+// Which definition wins when a local source and an API source share a
+// SourceID, in merged mode.
+const (
+	precedenceLocal = "local"
+	precedenceAPI   = "api"
+)
+
+const (
+	defaultSourceMode       = sourceModeAPI
+	defaultSourcePrecedence = precedenceLocal
+)
+
+// sourceFileExts are the files read from the sources directory.
+var sourceFileExts = map[string]bool{
+	".yaml": true,
+	".yml":  true,
+	".json": true,
+}
+
+// validSourceSettings checks the source mode and precedence.
+func (c *Config) validSourceSettings() error {
+	switch c.SourceMode {
+	case sourceModeAPI, sourceModeLocal, sourceModeMerged:
+	default:
+		return errors.Errorf("unknown source_mode: %q", c.SourceMode)
+	}
+
+	switch c.SourcePrecedence {
+	case precedenceLocal, precedenceAPI:
+	default:
+		return errors.Errorf("unknown source_precedence: %q", c.SourcePrecedence)
+	}
+
+	return nil
+}
+
+// loadLocalSources adds the sources of every file in the sources directory to
+// those from the config file, and validates them all. Files are read in name
+// order; each holds a "sources" list, in the same format as the config file
+// (see cache.Source), whether it's YAML or JSON. Intervals and steps are given
+// as duration strings, e.g. "30s". A SourceID may only be defined once across
+// all of them.
+func (c *Config) loadLocalSources() error {
+	origins := make(map[int]string)
+	var sources []cache.Source
+
+	add := func(origin string, srcs []cache.Source) error {
+		for _, src := range srcs {
+			if err := src.Validate(); err != nil {
+				return errors.Wrap(err, origin)
+			}
+			if prev, ok := origins[src.SourceID]; ok {
+				return errors.Errorf("source %d defined twice, in %s and %s", src.SourceID, prev, origin)
+			}
+
+			origins[src.SourceID] = origin
+			sources = append(sources, src)
+		}
+
+		return nil
+	}
+
+	if err := add("config file", c.Sources); err != nil {
+		return err
+	}
+
+	if c.SourcesDir != "" {
+		paths, err := sourceFiles(c.SourcesDir)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			srcs, err := readSourceFile(path)
+			if err != nil {
+				return err
+			}
+			if err := add(path, srcs); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.Sources = sources
+	return nil
+}
+
+// sourceFiles lists the source files in dir, sorted by name.
+func sourceFiles(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, errors.Wrap(err, "list sources directory")
+	}
+
+	var paths []string
+	for _, path := range matches {
+		if sourceFileExts[filepath.Ext(path)] {
+			paths = append(paths, path)
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func readSourceFile(path string) ([]cache.Source, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "read source file %s", path)
+	}
+
+	var sources []cache.Source
+	if err := v.UnmarshalKey("sources", &sources); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal source file %s", path)
+	}
+
+	return sources, nil
+}
+
+// combineSources returns the sources to run, given the latest sources from the
+// API, according to the source mode.
+func (c *Config) combineSources(apiSources []cache.Source) []cache.Source {
+	switch c.SourceMode {
+	case sourceModeLocal:
+		return c.Sources
+	case sourceModeMerged:
+		return mergeSources(c.Sources, apiSources, c.SourcePrecedence)
+	}
+
+	return apiSources
+}
+
+// mergeSources combines local and API sources. When both define the same
+// SourceID, the one given precedence is kept.
+func mergeSources(local, api []cache.Source, precedence string) []cache.Source {
+	localIDs := make(map[int]bool, len(local))
+	for _, src := range local {
+		localIDs[src.SourceID] = true
+	}
+	apiIDs := make(map[int]bool, len(api))
+	for _, src := range api {
+		apiIDs[src.SourceID] = true
+	}
+
+	merged := make([]cache.Source, 0, len(local)+len(api))
+	for _, src := range api {
+		if localIDs[src.SourceID] && precedence == precedenceLocal {
+			log.Printf("WARNING (sources): source %d is defined locally and by the API, using the local definition\n", src.SourceID)
+			continue
+		}
+		merged = append(merged, src)
+	}
+	for _, src := range local {
+		if apiIDs[src.SourceID] && precedence == precedenceAPI {
+			log.Printf("WARNING (sources): source %d is defined locally and by the API, using the API's definition\n", src.SourceID)
+			continue
+		}
+		merged = append(merged, src)
+	}
+
+	return merged
+}
+
+// usesAPI tells whether the collector talks to the Mindsight API at all: for
+// its sources, or to push metrics.
+func (c *Config) usesAPI() bool {
+	if c.SourceMode != sourceModeLocal {
+		return true
+	}
+
+	for _, sc := range c.Sinks {
+		if sc.Type == sinkMindsight {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MindsightCo/collector/cache"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+const yamlSources = `
+sources:
+  - id: 2
+    sourceURL: http://prometheus:9090
+    query: up{job="a"}
+    interval: 1m
+    mode: range
+    step: 15s
+`
+
+const jsonSources = `
+{
+	"sources": [
+		{"id": 3, "sourceURL": "http://thanos:10902", "query": "sum(up)", "connection": "thanos"}
+	]
+}
+`
+
+func writeSourceFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "sources-test")
+	if err != nil {
+		t.Fatal("create temp dir:", err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal("write source file:", err)
+		}
+	}
+
+	return dir
+}
+
+func TestLoadLocalSources(t *testing.T) {
+	dir := writeSourceFiles(t, map[string]string{
+		"b.yaml":    yamlSources,
+		"c.json":    jsonSources,
+		"notes.txt": "not a source file",
+	})
+	defer os.RemoveAll(dir)
+
+	c := &Config{
+		Sources:    []cache.Source{{SourceID: 1, URL: "http://prometheus:9090", Query: `up{job="b"}`}},
+		SourcesDir: dir,
+	}
+	if err := c.loadLocalSources(); err != nil {
+		t.Fatal("load local sources:", err)
+	}
+
+	expected := []cache.Source{
+		{SourceID: 1, URL: "http://prometheus:9090", Query: `up{job="b"}`},
+		{SourceID: 2, URL: "http://prometheus:9090", Query: `up{job="a"}`, Interval: time.Minute, Mode: cache.ModeRange, Step: 15 * time.Second},
+		{SourceID: 3, URL: "http://thanos:10902", Query: "sum(up)", Connection: "thanos"},
+	}
+	if !cmp.Equal(expected, c.Sources, cmpopts.IgnoreUnexported(cache.Source{})) {
+		t.Fatal("unexpected sources:", cmp.Diff(expected, c.Sources, cmpopts.IgnoreUnexported(cache.Source{})))
+	}
+}
+
+func TestLoadLocalSourcesInvalid(t *testing.T) {
+	var cases = []struct {
+		name   string
+		files  map[string]string
+		expErr string
+	}{
+		{
+			name:   "duplicate id",
+			files:  map[string]string{"a.yaml": yamlSources, "b.yml": yamlSources},
+			expErr: "source 2 defined twice",
+		},
+		{
+			name:   "missing url",
+			files:  map[string]string{"a.yaml": "sources:\n  - id: 4\n    query: up\n"},
+			expErr: "a.yaml",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeSourceFiles(t, tc.files)
+			defer os.RemoveAll(dir)
+
+			c := &Config{SourcesDir: dir}
+			err := c.loadLocalSources()
+			if err == nil || !strings.Contains(err.Error(), tc.expErr) {
+				t.Fatalf("expected an error containing %q, got: %v", tc.expErr, err)
+			}
+		})
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	local := []cache.Source{
+		{SourceID: 1, URL: "http://local", Query: "local_1"},
+		{SourceID: 2, URL: "http://local", Query: "local_2"},
+	}
+	api := []cache.Source{
+		{SourceID: 2, URL: "http://api", Query: "api_2"},
+		{SourceID: 3, URL: "http://api", Query: "api_3"},
+	}
+
+	var cases = []struct {
+		precedence string
+		expected   []cache.Source
+	}{
+		{
+			precedence: precedenceLocal,
+			expected:   []cache.Source{api[1], local[0], local[1]},
+		},
+		{
+			precedence: precedenceAPI,
+			expected:   []cache.Source{api[0], api[1], local[0]},
+		},
+	}
+
+	for _, tc := range cases {
+		merged := mergeSources(local, api, tc.precedence)
+		if !cmp.Equal(tc.expected, merged, cmpopts.IgnoreUnexported(cache.Source{})) {
+			t.Errorf("precedence %s: unexpected sources: %s", tc.precedence, cmp.Diff(tc.expected, merged, cmpopts.IgnoreUnexported(cache.Source{})))
+		}
+	}
+}
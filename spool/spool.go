@@ -0,0 +1,529 @@
+// package spool implements a durable, disk-backed FIFO of flushed metric
+// batches. Batches are appended to checksummed segment files and are handed
+// back in order by Drain, so data that couldn't be pushed survives API outages
+// and agent restarts.
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorName    = "cursor"
+
+	// each record is: 4 byte payload length, 4 byte CRC-32C of the payload, payload
+	headerSize = 8
+
+	defaultSegmentBytes = 8 << 20
+	defaultMaxBytes     = 512 << 20
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorrupt = errors.New("corrupt spool record")
+)
+
+// Options controls how much data the spool retains. Zero values select
+// defaults, except MaxAge where zero means segments never expire.
+type Options struct {
+	// SegmentBytes is the size after which a new segment file is started.
+	SegmentBytes int64
+	// MaxBytes caps the total size of all segments. The oldest segments are
+	// discarded when it is exceeded.
+	MaxBytes int64
+	// MaxAge discards segments that were last written longer ago than this.
+	MaxAge time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.SegmentBytes <= 0 {
+		o.SegmentBytes = defaultSegmentBytes
+	}
+	if o.MaxBytes <= 0 {
+		o.MaxBytes = defaultMaxBytes
+	}
+	return o
+}
+
+// PushFunc delivers a single batch, along with the sequence number it was
+// appended with. Returning an error leaves the batch at the head of the spool
+// so it is retried by the next Drain.
+type PushFunc func(ctx context.Context, seq uint64, batch map[int]prommodel.Vector) error
+
+// record is the payload of a spool record.
+type record struct {
+	Seq     uint64                   `json:"seq,omitempty"`
+	Metrics map[int]prommodel.Vector `json:"metrics"`
+}
+
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+type position struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Spool is a write-ahead buffer of metric batches stored in a directory.
+// It is safe for concurrent use.
+type Spool struct {
+	// drainMu lets one Drain run at a time. mu guards everything else, and
+	// isn't held while a batch is being pushed.
+	drainMu  sync.Mutex
+	mu       sync.Mutex
+	dir      string
+	opts     Options
+	segments []*segment
+	head     *os.File
+	cursor   position
+	nowFn    func() time.Time
+}
+
+// Open opens (or creates) the spool in dir. Batches left over from a previous
+// run are kept and will be returned by Drain before any new ones. A torn write
+// at the end of the newest segment is truncated away.
+func Open(dir string, opts Options) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create spool directory")
+	}
+
+	s := &Spool{
+		dir:   dir,
+		opts:  opts.withDefaults(),
+		nowFn: time.Now,
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "list spool segments")
+	}
+	s.segments = segments
+
+	if err := s.readCursor(); err != nil {
+		return nil, errors.Wrap(err, "read spool cursor")
+	}
+
+	if n := len(s.segments); n > 0 {
+		if err := repair(s.segments[n-1]); err != nil {
+			return nil, errors.Wrap(err, "repair last spool segment")
+		}
+	}
+
+	var next uint64 = 1
+	if n := len(s.segments); n > 0 {
+		next = s.segments[n-1].seq + 1
+	}
+	if err := s.openHead(next); err != nil {
+		return nil, err
+	}
+
+	if err := s.removeConsumed(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close releases the segment currently being written.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.head == nil {
+		return nil
+	}
+
+	err := s.head.Close()
+	s.head = nil
+	return err
+}
+
+// Append durably writes batch, with its sequence number, to the end of the
+// spool. Empty batches are ignored.
+func (s *Spool) Append(seq uint64, batch map[int]prommodel.Vector) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(record{Seq: seq, Metrics: batch})
+	if err != nil {
+		return errors.Wrap(err, "json marshal batch")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.head == nil {
+		return errors.New("spool is closed")
+	}
+
+	data := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.Checksum(payload, crcTable))
+	copy(data[headerSize:], payload)
+
+	if _, err := s.head.Write(data); err != nil {
+		return errors.Wrap(err, "write spool record")
+	}
+	if err := s.head.Sync(); err != nil {
+		return errors.Wrap(err, "sync spool segment")
+	}
+
+	head := s.segments[len(s.segments)-1]
+	head.size += int64(len(data))
+	head.modTime = s.nowFn()
+
+	if head.size >= s.opts.SegmentBytes {
+		if err := s.head.Close(); err != nil {
+			return errors.Wrap(err, "close full spool segment")
+		}
+		if err := s.openHead(head.seq + 1); err != nil {
+			return err
+		}
+	}
+
+	return s.enforceLimits()
+}
+
+// Drain hands up to limit spooled batches to push, oldest first, removing
+// each one after push succeeds. A limit of zero or less drains the whole
+// spool. It stops at the first push error and returns it. Batches can be
+// appended while one is being pushed, but only one Drain runs at a time.
+func (s *Spool) Drain(ctx context.Context, limit int, push PushFunc) error {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	for n := 0; limit <= 0 || n < limit; n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		rec, next, err := s.next()
+		s.mu.Unlock()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read spool")
+		}
+
+		if err := push(ctx, rec.Seq, rec.Metrics); err != nil {
+			return errors.Wrap(err, "push spooled batch")
+		}
+
+		if err := s.advance(next); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// advance moves the cursor past a batch that was pushed.
+func (s *Spool) advance(next position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cursor = next
+	if err := s.writeCursor(); err != nil {
+		return errors.Wrap(err, "write spool cursor")
+	}
+
+	return s.removeConsumed()
+}
+
+// Pending reports whether there are batches in the spool that haven't been
+// drained yet.
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		if seg.seq > s.cursor.Segment && seg.size > 0 {
+			return true
+		}
+		if seg.seq == s.cursor.Segment && seg.size > s.cursor.Offset {
+			return true
+		}
+	}
+
+	return false
+}
+
+// next returns the record at the cursor and the position just after it, or
+// io.EOF if there is nothing left to read. Segments found to be corrupt are
+// skipped, since they can never be delivered.
+func (s *Spool) next() (record, position, error) {
+	for idx, seg := range s.segments {
+		if seg.seq < s.cursor.Segment {
+			continue
+		}
+
+		var offset int64
+		if seg.seq == s.cursor.Segment {
+			offset = s.cursor.Offset
+		}
+		if offset >= seg.size {
+			continue
+		}
+
+		payload, err := readRecord(seg.path, offset)
+		if errors.Cause(err) == errCorrupt && idx < len(s.segments)-1 {
+			log.Printf("WARNING (spool): skipping corrupt segment %s at offset %d\n", seg.path, offset)
+			s.cursor = position{Segment: seg.seq + 1}
+			continue
+		}
+		if err != nil {
+			return record{}, position{}, err
+		}
+
+		var rec record
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return record{}, position{}, errors.Wrap(err, "json unmarshal batch")
+		}
+
+		return rec, position{Segment: seg.seq, Offset: offset + headerSize + int64(len(payload))}, nil
+	}
+
+	return record{}, position{}, io.EOF
+}
+
+func (s *Spool) openHead(seq uint64) error {
+	path := filepath.Join(s.dir, segmentName(seq))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open spool segment")
+	}
+
+	s.head = f
+	s.segments = append(s.segments, &segment{
+		seq:     seq,
+		path:    path,
+		modTime: s.nowFn(),
+	})
+
+	return nil
+}
+
+// enforceLimits discards the oldest segments while the spool is over its size
+// or age limits. The segment being written is never discarded.
+func (s *Spool) enforceLimits() error {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+
+	now := s.nowFn()
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		expired := s.opts.MaxAge > 0 && now.Sub(oldest.modTime) > s.opts.MaxAge
+		if total <= s.opts.MaxBytes && !expired {
+			break
+		}
+
+		if s.unread(oldest) > 0 {
+			log.Printf("WARNING (spool): discarding %d unpushed bytes in %s (spool limits exceeded)\n", s.unread(oldest), oldest.path)
+		}
+		if err := os.Remove(oldest.path); err != nil {
+			return errors.Wrap(err, "remove spool segment")
+		}
+
+		total -= oldest.size
+		s.segments = s.segments[1:]
+	}
+
+	return nil
+}
+
+// removeConsumed deletes segments that have been completely drained, other
+// than the one currently being written.
+func (s *Spool) removeConsumed() error {
+	for len(s.segments) > 1 && s.unread(s.segments[0]) == 0 {
+		if err := os.Remove(s.segments[0].path); err != nil {
+			return errors.Wrap(err, "remove drained spool segment")
+		}
+		s.segments = s.segments[1:]
+	}
+
+	return nil
+}
+
+func (s *Spool) unread(seg *segment) int64 {
+	switch {
+	case seg.seq < s.cursor.Segment:
+		return 0
+	case seg.seq == s.cursor.Segment:
+		if seg.size < s.cursor.Offset {
+			return 0
+		}
+		return seg.size - s.cursor.Offset
+	default:
+		return seg.size
+	}
+}
+
+func (s *Spool) readCursor() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, cursorName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &s.cursor)
+}
+
+// writeCursor atomically replaces the cursor file so a crash never leaves a
+// partially written position behind.
+func (s *Spool) writeCursor() error {
+	data, err := json.Marshal(s.cursor)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, cursorName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(s.dir, cursorName))
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentSuffix)
+}
+
+func listSegments(dir string) ([]*segment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*segment
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, &segment{
+			seq:     seq,
+			path:    filepath.Join(dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+
+	return segments, nil
+}
+
+func readRecord(path string, offset int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return decodeRecord(bufio.NewReader(f))
+}
+
+func decodeRecord(r io.Reader) ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errors.Wrap(errCorrupt, err.Error())
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Wrap(errCorrupt, err.Error())
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.Wrap(errCorrupt, "checksum mismatch")
+	}
+
+	return payload, nil
+}
+
+// repair truncates seg after its last complete, valid record.
+func repair(seg *segment) error {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var valid int64
+	for valid < seg.size {
+		payload, err := decodeRecord(r)
+		if err != nil {
+			break
+		}
+		valid += headerSize + int64(len(payload))
+	}
+
+	if valid == seg.size {
+		return nil
+	}
+
+	log.Printf("WARNING (spool): truncating %d bytes of incomplete data from %s\n", seg.size-valid, seg.path)
+	if err := f.Truncate(valid); err != nil {
+		return err
+	}
+	seg.size = valid
+
+	return f.Sync()
+}
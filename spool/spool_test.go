@@ -0,0 +1,331 @@
+package spool
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	prommodel "github.com/prometheus/common/model"
+)
+
+var epoch = prommodel.TimeFromUnix(10)
+
+func testBatch(id int, value float64) map[int]prommodel.Vector {
+	return map[int]prommodel.Vector{
+		id: prommodel.Vector{
+			&prommodel.Sample{
+				Timestamp: epoch,
+				Value:     prommodel.SampleValue(value),
+				Metric: prommodel.Metric{
+					"__name__": "joeblow",
+				},
+			},
+		},
+	}
+}
+
+func testDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "spool-test")
+	if err != nil {
+		t.Fatal("create temp dir:", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func collect(t *testing.T, s *Spool) []map[int]prommodel.Vector {
+	t.Helper()
+
+	var got []map[int]prommodel.Vector
+	err := s.Drain(context.Background(), 0, func(ctx context.Context, seq uint64, batch map[int]prommodel.Vector) error {
+		got = append(got, batch)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("drain:", err)
+	}
+
+	return got
+}
+
+func TestAppendDrain(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, err := Open(dir, Options{SegmentBytes: 64})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+	defer s.Close()
+
+	expected := []map[int]prommodel.Vector{testBatch(1, 1.1), testBatch(2, 2.2), testBatch(3, 3.3)}
+	for i, batch := range expected {
+		if err := s.Append(uint64(i+1), batch); err != nil {
+			t.Fatal("append:", err)
+		}
+	}
+
+	if !s.Pending() {
+		t.Fatal("spool should have pending batches")
+	}
+
+	got := collect(t, s)
+	if !cmp.Equal(expected, got) {
+		t.Fatal("unexpected drained batches:", cmp.Diff(expected, got))
+	}
+	if s.Pending() {
+		t.Fatal("spool should be empty after drain")
+	}
+	if len(s.segments) != 1 {
+		t.Fatal("drained segments were not removed, segments left:", len(s.segments))
+	}
+}
+
+func TestDrainStopsOnError(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+	defer s.Close()
+
+	s.Append(1, testBatch(1, 1.1))
+	s.Append(2, testBatch(2, 2.2))
+
+	nCalls := 0
+	err = s.Drain(context.Background(), 0, func(ctx context.Context, seq uint64, batch map[int]prommodel.Vector) error {
+		nCalls++
+		return errors.New("api down")
+	})
+	if err == nil {
+		t.Fatal("expected drain to return the push error")
+	}
+	if nCalls != 1 {
+		t.Fatal("drain should stop at the first failure, calls:", nCalls)
+	}
+
+	expected := []map[int]prommodel.Vector{testBatch(1, 1.1), testBatch(2, 2.2)}
+	if got := collect(t, s); !cmp.Equal(expected, got) {
+		t.Fatal("unexpected drained batches after failure:", cmp.Diff(expected, got))
+	}
+}
+
+func TestDrainLimit(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+	defer s.Close()
+
+	s.Append(1, testBatch(1, 1.1))
+	s.Append(2, testBatch(2, 2.2))
+	s.Append(3, testBatch(3, 3.3))
+
+	var got []map[int]prommodel.Vector
+	err = s.Drain(context.Background(), 2, func(ctx context.Context, seq uint64, batch map[int]prommodel.Vector) error {
+		got = append(got, batch)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("drain:", err)
+	}
+
+	expected := []map[int]prommodel.Vector{testBatch(1, 1.1), testBatch(2, 2.2)}
+	if !cmp.Equal(expected, got) {
+		t.Fatal("unexpected batches drained within the limit:", cmp.Diff(expected, got))
+	}
+	if !s.Pending() {
+		t.Fatal("batch past the limit was not left in the spool")
+	}
+
+	expected = []map[int]prommodel.Vector{testBatch(3, 3.3)}
+	if got := collect(t, s); !cmp.Equal(expected, got) {
+		t.Fatal("unexpected batches drained after the limit:", cmp.Diff(expected, got))
+	}
+}
+
+func TestAppendDuringDrain(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+	defer s.Close()
+
+	s.Append(1, testBatch(1, 1.1))
+
+	// a slow push mustn't keep new batches from being spooled
+	appended := make(chan error, 1)
+	err = s.Drain(context.Background(), 1, func(ctx context.Context, seq uint64, batch map[int]prommodel.Vector) error {
+		go func() { appended <- s.Append(2, testBatch(2, 2.2)) }()
+
+		select {
+		case err := <-appended:
+			return err
+		case <-time.After(time.Second * 5):
+			return errors.New("append blocked by the push")
+		}
+	})
+	if err != nil {
+		t.Fatal("drain:", err)
+	}
+
+	expected := []map[int]prommodel.Vector{testBatch(2, 2.2)}
+	if got := collect(t, s); !cmp.Equal(expected, got) {
+		t.Fatal("unexpected batches drained after appending during a push:", cmp.Diff(expected, got))
+	}
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, err := Open(dir, Options{SegmentBytes: 64})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+
+	s.Append(1, testBatch(1, 1.1))
+	s.Append(2, testBatch(2, 2.2))
+	s.Append(3, testBatch(3, 3.3))
+
+	// consume only the first batch before "crashing"
+	pushed := false
+	s.Drain(context.Background(), 0, func(ctx context.Context, seq uint64, batch map[int]prommodel.Vector) error {
+		if pushed {
+			return errors.New("api down")
+		}
+		pushed = true
+		return nil
+	})
+	s.Close()
+
+	// simulate a torn write at the end of the newest segment
+	segments, _ := listSegments(dir)
+	last := segments[len(segments)-1].path
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal("open segment:", err)
+	}
+	f.Write([]byte{0, 0, 1})
+	f.Close()
+
+	s, err = Open(dir, Options{SegmentBytes: 64})
+	if err != nil {
+		t.Fatal("reopen spool:", err)
+	}
+	defer s.Close()
+
+	expected := []map[int]prommodel.Vector{testBatch(2, 2.2), testBatch(3, 3.3)}
+	if got := collect(t, s); !cmp.Equal(expected, got) {
+		t.Fatal("unexpected replayed batches:", cmp.Diff(expected, got))
+	}
+}
+
+func TestSkipsCorruptSegment(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, err := Open(dir, Options{SegmentBytes: 1})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+	defer s.Close()
+
+	s.Append(1, testBatch(1, 1.1))
+	s.Append(2, testBatch(2, 2.2))
+
+	// flip a payload byte so the checksum no longer matches
+	path := s.segments[0].path
+	data, _ := ioutil.ReadFile(path)
+	data[headerSize+1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal("corrupt segment:", err)
+	}
+
+	expected := []map[int]prommodel.Vector{testBatch(2, 2.2)}
+	if got := collect(t, s); !cmp.Equal(expected, got) {
+		t.Fatal("unexpected batches with a corrupt segment:", cmp.Diff(expected, got))
+	}
+}
+
+func TestLimits(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	now := epoch.Time()
+	s, err := Open(dir, Options{SegmentBytes: 1, MaxBytes: 1 << 20, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+	defer s.Close()
+	s.nowFn = func() time.Time { return now }
+
+	s.Append(1, testBatch(1, 1.1))
+	now = now.Add(2 * time.Hour)
+	s.Append(2, testBatch(2, 2.2))
+
+	expected := []map[int]prommodel.Vector{testBatch(2, 2.2)}
+	if got := collect(t, s); !cmp.Equal(expected, got) {
+		t.Fatal("expired batch was not discarded:", cmp.Diff(expected, got))
+	}
+
+	s.opts.MaxBytes = 100
+	s.Append(3, testBatch(3, 3.3))
+	s.Append(4, testBatch(4, 4.4))
+
+	expected = []map[int]prommodel.Vector{testBatch(4, 4.4)}
+	if got := collect(t, s); !cmp.Equal(expected, got) {
+		t.Fatal("oversized spool was not trimmed:", cmp.Diff(expected, got))
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, cursorName)); err != nil {
+		t.Fatal("cursor file was not written:", err)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal("open spool:", err)
+	}
+	defer s.Close()
+
+	s.Append(7, testBatch(1, 1.1))
+	s.Append(42, testBatch(2, 2.2))
+
+	var seqs []uint64
+	var got []map[int]prommodel.Vector
+	err = s.Drain(context.Background(), 0, func(ctx context.Context, seq uint64, batch map[int]prommodel.Vector) error {
+		seqs = append(seqs, seq)
+		got = append(got, batch)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("drain:", err)
+	}
+
+	if expected := []uint64{7, 42}; !cmp.Equal(expected, seqs) {
+		t.Fatal("unexpected sequence numbers:", cmp.Diff(expected, seqs))
+	}
+	if expected := []map[int]prommodel.Vector{testBatch(1, 1.1), testBatch(2, 2.2)}; !cmp.Equal(expected, got) {
+		t.Fatal("unexpected drained batches:", cmp.Diff(expected, got))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const checkpointsFile = "checkpoints.json"
+
+// loadCheckpoints reads the range query checkpoints saved in dir. A missing
+// file isn't an error, it just means there's nothing to resume from.
+func loadCheckpoints(dir string) (map[int]time.Time, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, checkpointsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read checkpoints")
+	}
+
+	var checkpoints map[int]time.Time
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return nil, errors.Wrap(err, "json unmarshal checkpoints")
+	}
+
+	return checkpoints, nil
+}
+
+// saveCheckpoints atomically replaces the range query checkpoints saved in dir.
+func saveCheckpoints(dir string, checkpoints map[int]time.Time) error {
+	data, err := json.Marshal(checkpoints)
+	if err != nil {
+		return errors.Wrap(err, "json marshal checkpoints")
+	}
+
+	return writeFileAtomic(filepath.Join(dir, checkpointsFile), data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+const sequenceFile = "sequence.json"
+
+// sequenceState identifies the collector and the batches it pushes, across
+// restarts.
+type sequenceState struct {
+	InstanceID string `json:"instance_id"`
+	// LastSeq is the last sequence number given to a batch, AckedSeq the last
+	// one delivered in order.
+	LastSeq  uint64 `json:"last_seq"`
+	AckedSeq uint64 `json:"acked_seq"`
+}
+
+// loadSequence reads the sequence state saved in dir. A missing file yields
+// the zero state.
+func loadSequence(dir string) (sequenceState, error) {
+	var state sequenceState
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, sequenceFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, errors.Wrap(err, "read sequence state")
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, errors.Wrap(err, "json unmarshal sequence state")
+	}
+
+	return state, nil
+}
+
+// saveSequence atomically replaces the sequence state saved in dir.
+func saveSequence(dir string, state sequenceState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "json marshal sequence state")
+	}
+
+	return writeFileAtomic(filepath.Join(dir, sequenceFile), data)
+}
+
+// newInstanceID returns a random identity for a collector that wasn't given
+// one.
+func newInstanceID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,130 @@
+// package telemetry holds the collector's own Prometheus metrics, so the
+// collector can be scraped by the same Prometheus it reads from.
+package telemetry
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mindsight_collector"
+
+// Flush reasons for CacheFlushes.
+const (
+	FlushSize     = "size"
+	FlushAge      = "age"
+	FlushOverflow = "overflow"
+)
+
+var (
+	// Registry holds every collector metric, plus the standard Go runtime
+	// and process metrics.
+	Registry = prometheus.NewRegistry()
+
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Duration of queries against prometheus servers, by source.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"source_id"})
+
+	QueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_errors_total",
+		Help:      "Number of failed queries, by source.",
+	}, []string{"source_id"})
+
+	SamplesCollected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "samples_collected_total",
+		Help:      "Number of samples added to the cache, by source.",
+	}, []string{"source_id"})
+
+	CacheDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_samples",
+		Help:      "Number of samples currently held in the cache.",
+	})
+
+	CacheFlushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_flushes_total",
+		Help:      "Number of cache flushes, by reason (size, age or overflow).",
+	}, []string{"reason"})
+
+	SamplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "samples_dropped_total",
+		Help:      "Number of samples discarded because the cache was full, by source.",
+	}, []string{"source_id"})
+
+	PushDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "push_duration_seconds",
+		Help:      "Duration of individual push requests to the API.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	PushRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_requests_total",
+		Help:      "Number of push requests to the API, by HTTP status code (\"error\" if no response was received).",
+	}, []string{"code"})
+
+	PushBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_bytes_total",
+		Help:      "Number of request body bytes sent to the API.",
+	})
+
+	TokenRefreshes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Number of new API access tokens obtained.",
+	})
+
+	SourceRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_refreshes_total",
+		Help:      "Number of metric source refreshes from the API, by result (success or failure).",
+	}, []string{"result"})
+
+	SourcesQuarantined = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sources_quarantined",
+		Help:      "Number of sources not scheduled because their query is invalid.",
+	})
+
+	SinkPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_pushes_total",
+		Help:      "Number of batches pushed to each sink, by result (success or failure).",
+	}, []string{"sink", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		QueryDuration,
+		QueryErrors,
+		SamplesCollected,
+		CacheDepth,
+		CacheFlushes,
+		SamplesDropped,
+		PushDuration,
+		PushRequests,
+		PushBytes,
+		TokenRefreshes,
+		SourceRefreshes,
+		SinkPushes,
+		SourcesQuarantined,
+	)
+}
+
+// Handler serves the metrics in Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,31 @@
+package telemetry
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	CacheFlushes.WithLabelValues(FlushSize).Inc()
+	QueryErrors.WithLabelValues("7").Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal("read metrics:", err)
+	}
+
+	for _, expected := range []string{
+		`mindsight_collector_cache_flushes_total{reason="size"} 1`,
+		`mindsight_collector_query_errors_total{source_id="7"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("metrics output is missing %s:\n%s", expected, body)
+		}
+	}
+}
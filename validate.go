@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/MindsightCo/collector/apiclient"
+	"github.com/MindsightCo/collector/cache"
+	promclient "github.com/MindsightCo/collector/prometheus_client"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// report collects the outcome of each check made by validate.
+type report struct {
+	out      io.Writer
+	failures int
+	warnings int
+	// problems describes every failed check.
+	problems []string
+}
+
+func (r *report) ok(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "[ OK ] "+format+"\n", args...)
+}
+
+func (r *report) warn(format string, args ...interface{}) {
+	r.warnings++
+	fmt.Fprintf(r.out, "[WARN] "+format+"\n", args...)
+}
+
+func (r *report) fail(format string, args ...interface{}) {
+	r.failures++
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+	fmt.Fprintf(r.out, "[FAIL] "+format+"\n", args...)
+}
+
+// check fails if bad, and reports nothing otherwise.
+func (r *report) check(bad bool, format string, args ...interface{}) {
+	if bad {
+		r.fail(format, args...)
+	}
+}
+
+// validate checks the configuration and everything it refers to: settings are
+// in sane ranges, the credentials work, every source's query parses and its
+// server answers it. The report is written to out, and false is returned if
+// any check failed.
+func validate(ctx context.Context, out io.Writer) bool {
+	r := &report{out: out}
+	defer func() {
+		fmt.Fprintf(out, "\n%d failure(s), %d warning(s)\n", r.failures, r.warnings)
+	}()
+
+	c, err := ReadConfig()
+	if err != nil {
+		r.fail("config: %v", err)
+		return false
+	}
+	if file := viper.ConfigFileUsed(); file != "" {
+		r.ok("config read from %s", file)
+	} else {
+		r.warn("no config file found, using the environment and defaults only")
+	}
+
+	c.checkSettings(r)
+	c.checkSinks(r)
+
+	var apiSources []cache.Source
+	if c.usesAPI() {
+		if err := c.initAuth(true); err != nil {
+			r.fail("credentials: %v", err)
+		} else {
+			r.ok("credentials accepted")
+
+			if c.SourceMode != sourceModeLocal {
+				apiSources, err = c.fetchSources(ctx)
+				if err != nil {
+					r.fail("sources from the API: %v", err)
+				} else {
+					r.ok("%d source(s) from the API", len(apiSources))
+				}
+			}
+		}
+	}
+	if c.SourceMode != sourceModeAPI {
+		r.ok("%d local source(s)", len(c.Sources))
+	}
+
+	c.checkSources(ctx, r, c.combineSources(apiSources))
+
+	return r.failures == 0
+}
+
+// checkSettings reports settings that are out of their sane range.
+func (c *Config) checkSettings(r *report) {
+	n := r.failures
+
+	r.check(c.ScrapeInterval <= 0, "scrape_interval must be positive, got: %s", c.ScrapeInterval)
+	r.check(c.CacheAge <= 0, "cache_age must be positive, got: %s", c.CacheAge)
+	r.check(c.CacheDepth <= 0, "cache_depth must be positive, got: %d", c.CacheDepth)
+	r.check(c.CacheMaxSamples < 0, "cache_max_samples can't be negative, got: %d", c.CacheMaxSamples)
+	if err := cache.ValidOverflowPolicy(c.CacheOverflowPolicy); err != nil {
+		r.fail("cache_overflow_policy: %v", err)
+	}
+	r.check(c.QueryTimeout <= 0, "query_timeout must be positive, got: %s", c.QueryTimeout)
+	r.check(c.MaxConcurrentQueries < 0, "max_concurrent_queries can't be negative, got: %d", c.MaxConcurrentQueries)
+	r.check(c.MaxQueriesPerServer < 0, "max_queries_per_server can't be negative, got: %d", c.MaxQueriesPerServer)
+	r.check(c.RangeMaxLookback < 0, "range_max_lookback can't be negative, got: %s", c.RangeMaxLookback)
+	r.check(c.PushMaxAttempts < 1, "push_max_attempts must be at least 1, got: %d", c.PushMaxAttempts)
+	r.check(c.PushInitialBackoff <= 0, "push_initial_backoff must be positive, got: %s", c.PushInitialBackoff)
+	r.check(c.PushMaxBackoff < c.PushInitialBackoff, "push_max_backoff (%s) is below push_initial_backoff (%s)", c.PushMaxBackoff, c.PushInitialBackoff)
+	r.check(c.PushBackoffJitter < 0 || c.PushBackoffJitter > 1, "push_backoff_jitter must be between 0 and 1, got: %g", c.PushBackoffJitter)
+	r.check(c.PushAttemptTimeout < 0, "push_attempt_timeout can't be negative, got: %s", c.PushAttemptTimeout)
+	r.check(c.PushMaxBytes < 0, "push_max_bytes can't be negative, got: %d", c.PushMaxBytes)
+	r.check(c.PushMaxSamples < 0, "push_max_samples can't be negative, got: %d", c.PushMaxSamples)
+	r.check(c.ShutdownGracePeriod <= 0, "shutdown_grace_period must be positive, got: %s", c.ShutdownGracePeriod)
+	r.check(c.HealthMaxScrapeAge < 0 || c.HealthMaxPushAge < 0 || c.HealthMaxRefreshAge < 0, "health_max_*_age can't be negative")
+
+	if c.SourceMode != sourceModeLocal {
+		r.check(c.RefreshSourcesInterval <= 0, "refresh_sources_interval must be positive, got: %s", c.RefreshSourcesInterval)
+		r.check(c.SubscribeSources && c.SubscribeRetryInterval <= 0, "subscribe_retry_interval must be positive, got: %s", c.SubscribeRetryInterval)
+	}
+
+	if c.SpoolDir != "" {
+		r.check(c.SpoolMaxBytes <= 0, "spool_max_bytes must be positive, got: %d", c.SpoolMaxBytes)
+		r.check(c.SpoolSegmentBytes <= 0 || c.SpoolSegmentBytes > c.SpoolMaxBytes,
+			"spool_segment_bytes must be positive and at most spool_max_bytes, got: %d", c.SpoolSegmentBytes)
+		r.check(c.SpoolMaxAge < 0, "spool_max_age can't be negative, got: %s", c.SpoolMaxAge)
+		r.check(c.SpoolDrainBatches < 0, "spool_drain_batches can't be negative, got: %d", c.SpoolDrainBatches)
+	}
+
+	if r.failures == n {
+		r.ok("settings in range")
+	}
+
+	if c.ScrapeInterval > 0 && c.ScrapeInterval < time.Second {
+		r.warn("scrape_interval %s is very short", c.ScrapeInterval)
+	}
+	if c.QueryTimeout > c.ScrapeInterval {
+		r.warn("query_timeout (%s) is longer than scrape_interval (%s), slow queries can delay scrapes", c.QueryTimeout, c.ScrapeInterval)
+	}
+	if c.CacheMaxSamples > 0 && c.CacheMaxSamples < c.CacheDepth {
+		r.warn("cache_max_samples (%d) is below cache_depth (%d), samples will be dropped before the cache flushes", c.CacheMaxSamples, c.CacheDepth)
+	}
+}
+
+// settingsError runs the checks of checkSettings, for a configuration about to
+// be applied rather than validated: it returns the failed checks as an error,
+// or nil if there are none.
+func (c *Config) settingsError() error {
+	r := &report{out: ioutil.Discard}
+	c.checkSettings(r)
+	if len(r.problems) == 0 {
+		return nil
+	}
+
+	return errors.New(strings.Join(r.problems, "; "))
+}
+
+// checkSinks reports sinks that can't be set up. File sinks aren't opened,
+// so that validating doesn't create files.
+func (c *Config) checkSinks(r *report) {
+	for _, sc := range c.Sinks {
+		name := sc.Name
+		if name == "" {
+			name = sc.Type
+		}
+
+		if sc.Type == sinkFile {
+			if sc.Path == "" {
+				r.fail("sink %s: path must be given", name)
+			} else if _, err := os.Stat(filepath.Dir(sc.Path)); err != nil {
+				r.fail("sink %s: %v", name, err)
+			} else {
+				r.ok("sink %s", name)
+			}
+			continue
+		}
+
+		s, err := c.newSink(sc, apiclient.DefaultRetryPolicy)
+		if err != nil {
+			r.fail("sink %s: %v", name, err)
+			continue
+		}
+		if closer, ok := s.(io.Closer); ok {
+			closer.Close()
+		}
+		r.ok("sink %s", name)
+	}
+}
+
+// fetchSources gets the sources from the API once.
+func (c *Config) fetchSources(ctx context.Context) ([]cache.Source, error) {
+	queryer, err := apiclient.NewQueryer(c.APIServer, c.auth)
+	if err != nil {
+		return nil, errors.Wrap(err, "init queryer")
+	}
+
+	return queryer.QuerySources(ctx)
+}
+
+// checkSources checks every source's query, and runs it once against its
+// server.
+func (c *Config) checkSources(ctx context.Context, r *report, sources []cache.Source) {
+	probes, err := c.newProbeCache(sources)
+	if err != nil {
+		r.fail("sources: %v", err)
+		return
+	}
+
+	for _, src := range sources {
+		warnings, err := cache.CheckQuery(src.Query)
+		if cache.IsParseError(err) {
+			// the server decides, the probe below fails if it rejects it
+			r.warn("source %d: query %q can't be checked locally: %v", src.SourceID, src.Query, err)
+		} else if err != nil {
+			r.fail("source %d: query %q: %v", src.SourceID, src.Query, err)
+			continue
+		}
+		for _, warning := range warnings {
+			r.warn("source %d: %s", src.SourceID, warning)
+		}
+
+		vector, err := probes.QuerySource(ctx, src.SourceID)
+		switch {
+		case errors.Cause(err) == promclient.ErrNoData:
+			r.warn("source %d: %s answered, but the query matched no series", src.SourceID, src.URL)
+		case err != nil:
+			r.fail("%v", err)
+		default:
+			r.ok("source %d: %s answered with %d sample(s)", src.SourceID, src.URL, len(vector))
+		}
+	}
+}
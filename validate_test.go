@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/MindsightCo/collector/cache"
+)
+
+// defaultSettings returns a configuration with the default settings.
+func defaultSettings() *Config {
+	return &Config{
+		SourceMode:             defaultSourceMode,
+		CacheAge:               defaultCacheAge,
+		CacheDepth:             defaultCacheDepth,
+		CacheMaxSamples:        defaultCacheMaxSamples,
+		CacheOverflowPolicy:    defaultCacheOverflowPolicy,
+		ScrapeInterval:         defaultScrapeInterval,
+		RefreshSourcesInterval: defaultRefreshSourcesInterval,
+		SubscribeSources:       defaultSubscribeSources,
+		SubscribeRetryInterval: defaultSubscribeRetryInterval,
+		QueryTimeout:           defaultScrapeInterval,
+		PushMaxAttempts:        defaultPushMaxAttempts,
+		PushInitialBackoff:     defaultPushInitialBackoff,
+		PushMaxBackoff:         defaultPushMaxBackoff,
+		PushBackoffJitter:      defaultPushBackoffJitter,
+		PushAttemptTimeout:     defaultPushAttemptTimeout,
+		PushMaxBytes:           defaultPushMaxBytes,
+		PushMaxSamples:         defaultPushMaxSamples,
+		ShutdownGracePeriod:    defaultShutdownGracePeriod,
+	}
+}
+
+func TestCheckSettings(t *testing.T) {
+	var cases = []struct {
+		name     string
+		change   func(c *Config)
+		failures int
+	}{
+		{
+			name:   "defaults",
+			change: func(c *Config) {},
+		},
+		{
+			name:   "no push batch limits",
+			change: func(c *Config) { c.PushMaxBytes, c.PushMaxSamples = 0, 0 },
+		},
+		{
+			name:     "zero scrape interval",
+			change:   func(c *Config) { c.ScrapeInterval = 0 },
+			failures: 1,
+		},
+		{
+			name:     "unknown overflow policy",
+			change:   func(c *Config) { c.CacheOverflowPolicy = "drop_everything" },
+			failures: 1,
+		},
+		{
+			name:   "spill",
+			change: func(c *Config) { c.CacheOverflowPolicy = cache.OverflowSpill },
+		},
+		{
+			name:     "zero refresh interval",
+			change:   func(c *Config) { c.RefreshSourcesInterval = 0 },
+			failures: 1,
+		},
+		{
+			name: "zero refresh interval with local sources",
+			change: func(c *Config) {
+				c.SourceMode = sourceModeLocal
+				c.RefreshSourcesInterval = 0
+			},
+		},
+		{
+			name: "negative spool drain",
+			change: func(c *Config) {
+				c.SpoolDir = "/var/spool/mindsight"
+				c.SpoolMaxBytes = defaultSpoolMaxBytes
+				c.SpoolSegmentBytes = defaultSpoolSegmentBytes
+				c.SpoolDrainBatches = -1
+			},
+			failures: 1,
+		},
+		{
+			name:     "negative health age",
+			change:   func(c *Config) { c.HealthMaxPushAge = -time.Minute },
+			failures: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := defaultSettings()
+			tc.change(c)
+
+			r := &report{out: ioutil.Discard}
+			c.checkSettings(r)
+			if r.failures != tc.failures {
+				t.Fatalf("failures got: %d expected: %d (%v)", r.failures, tc.failures, r.problems)
+			}
+			if (c.settingsError() != nil) != (tc.failures > 0) {
+				t.Fatal("settingsError disagrees with checkSettings:", c.settingsError())
+			}
+		})
+	}
+}